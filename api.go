@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"onionbox/onion_buffer"
+)
+
+// The JSON API mirrors the HTML forms for scripts and other clients.
+//
+//	POST   /api/v1/uploads               create an upload from a multipart form
+//	GET    /api/v1/uploads/{name}         fetch an upload's metadata
+//	GET    /api/v1/uploads/{name}/content download the zip
+//	PATCH  /api/v1/uploads/{name}         change an upload's limits
+//	DELETE /api/v1/uploads/{name}         destroy an upload
+//
+// Uploads take the same multipart fields as the upload form, options first
+// and then one or more files, but no form token. Instead they must carry an
+// "Onionbox-Api: 1" header, which a cross-site form can't send, so another
+// page can't create uploads through a visitor's browser. Encrypted
+// uploads are downloaded by sending the password in the Onionbox-Password
+// header.
+// Changing or deleting an upload takes the management token returned on
+// creation, sent as "Authorization: Bearer <token>". PATCH takes a JSON
+// bufferUpdate. Errors are JSON objects of the form
+// {"error": {"code": "not_found", "message": "File not found"}}.
+const (
+	apiPath        = "/api/v1"
+	apiHeader      = "Onionbox-Api"
+	passwordHeader = "Onionbox-Password"
+)
+
+// apiUpload describes an upload in API responses.
+type apiUpload struct {
+	Name          string     `json:"name"`
+	URL           string     `json:"url"`
+	Checksum      string     `json:"checksum"`
+	Encrypted     bool       `json:"encrypted"`
+	Size          int        `json:"size"`
+	Downloads     int        `json:"downloads"`
+	DownloadLimit int        `json:"download_limit,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	ManageURL     string     `json:"manage_url,omitempty"`
+	Token         string     `json:"management_token,omitempty"`
+}
+
+// apiErrorBody is the body of every API error response.
+type apiErrorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// apiRoutes registers the API endpoints, errors under apiPath are JSON.
+func (ob *onionbox) apiRoutes(m *mux) {
+	m.handleErrors(apiPath, ob.apiError)
+	m.handle(apiPath+uploadsPath+"/{id}", ob.apiDescribe, http.MethodGet, http.MethodHead)
+	m.handle(apiPath+uploadsPath+"/{id}/content", ob.apiContent, http.MethodGet, http.MethodHead)
+	// Shares from the command line can only be downloaded
+	if ob.share != nil {
+		return
+	}
+	m.handle(apiPath+uploadsPath, ob.apiCreate, http.MethodPost)
+	m.handle(apiPath+uploadsPath+"/{id}", ob.apiUpdate, http.MethodPatch)
+	m.handle(apiPath+uploadsPath+"/{id}", ob.apiDelete, http.MethodDelete)
+}
+
+func (ob *onionbox) apiDescribe(w http.ResponseWriter, r *http.Request) {
+	if oBuffer := ob.lookup(w, r, ob.apiError); oBuffer != nil {
+		ob.writeJSON(w, http.StatusOK, ob.describe(oBuffer))
+	}
+}
+
+func (ob *onionbox) apiContent(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.lookup(w, r, ob.apiError)
+	if oBuffer == nil {
+		return
+	}
+	content, done := ob.openContent(w, oBuffer, r.Header.Get(passwordHeader), ob.apiError)
+	if content == nil {
+		return
+	}
+	defer done()
+	ob.serveBuffer(w, r, oBuffer, content, ob.apiError)
+}
+
+// apiCreate stores a multipart upload and returns its description along
+// with the management token, which is never shown again.
+func (ob *onionbox) apiCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(apiHeader) != "1" {
+		ob.apiError(w, "Uploads need the "+apiHeader+": 1 header.", http.StatusForbidden)
+		return
+	}
+	oBuffer, token := ob.receiveUpload(w, r, ob.apiError, false)
+	if oBuffer == nil {
+		return
+	}
+	upload := ob.describe(oBuffer)
+	upload.ManageURL = ob.manageURL(oBuffer.Name, token)
+	upload.Token = token
+	w.Header().Set("Location", apiPath+uploadsPath+"/"+oBuffer.Name)
+	ob.writeJSON(w, http.StatusCreated, upload)
+}
+
+// apiUpdate changes an upload's limits if the request carries its
+// management token.
+func (ob *onionbox) apiUpdate(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.lookup(w, r, ob.apiError)
+	if oBuffer == nil || !ob.apiAuthorized(w, r, oBuffer) {
+		return
+	}
+	var update bufferUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFormValue)).Decode(&update); err != nil {
+		ob.apiError(w, "Invalid JSON body.", http.StatusBadRequest)
+		return
+	}
+	if err := ob.updateBuffer(oBuffer, update); err != nil {
+		ob.apiError(w, "Download limit and expiration time can't be negative.", http.StatusBadRequest)
+		return
+	}
+	ob.writeJSON(w, http.StatusOK, ob.describe(oBuffer))
+}
+
+// apiDelete destroys an upload if the request carries its management
+// token.
+func (ob *onionbox) apiDelete(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.lookup(w, r, ob.apiError)
+	if oBuffer == nil || !ob.apiAuthorized(w, r, oBuffer) {
+		return
+	}
+	if err := ob.store.Delete(oBuffer); err != nil {
+		ob.logf("Error deleting onion file from store: %v", err)
+		ob.apiError(w, "Error deleting upload.", http.StatusInternalServerError)
+		return
+	}
+	ob.logf("Upload %s deleted by its uploader", oBuffer.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiAuthorized checks the request's bearer token against the buffer's
+// management token, rejecting the request if it doesn't match.
+func (ob *onionbox) apiAuthorized(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		ob.apiError(w, "Management token required.", http.StatusUnauthorized)
+		return false
+	}
+	if !oBuffer.ValidToken(strings.TrimPrefix(auth, "Bearer ")) {
+		ob.apiError(w, "Invalid management token.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// describe snapshots a buffer's metadata.
+func (ob *onionbox) describe(oBuffer *onion_buffer.OnionBuffer) apiUpload {
+	oBuffer.Lock()
+	defer oBuffer.Unlock()
+	upload := apiUpload{
+		Name:          oBuffer.Name,
+		URL:           ob.shareURL(oBuffer.Name),
+		Checksum:      oBuffer.Checksum,
+		Encrypted:     oBuffer.Encrypted,
+		Size:          len(oBuffer.Bytes),
+		Downloads:     oBuffer.Downloads,
+		DownloadLimit: oBuffer.DownloadLimit,
+		CreatedAt:     oBuffer.CreatedAt,
+	}
+	if !oBuffer.ExpiresAt.IsZero() {
+		expiresAt := oBuffer.ExpiresAt
+		upload.ExpiresAt = &expiresAt
+	}
+	return upload
+}
+
+// apiError responds with a JSON error, it stands in for http.Error in the
+// handlers shared with the HTML forms.
+func (ob *onionbox) apiError(w http.ResponseWriter, msg string, code int) {
+	var body apiErrorBody
+	body.Error.Code = strings.ToLower(strings.Replace(http.StatusText(code), " ", "_", -1))
+	body.Error.Message = msg
+	ob.writeJSON(w, code, body)
+}
+
+func (ob *onionbox) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ob.logf("Error writing to client: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"onionbox/onion_buffer"
+	"onionbox/templates"
+)
+
+// With -chat every share gets a chat room at /d/{name}/chat, so the
+// uploader and recipients can talk without leaving Tor Browser. Anyone
+// with the share link can join. Messages posted from the link on the
+// management page carry the management key and are marked as the
+// uploader's. Messages are only ever held in memory, capped per room, and
+// are wiped when the share goes away or onionbox shuts down.
+//
+// The page works without JavaScript, posting a form and reloading. With
+// JavaScript, /static/chat.js posts in the background and long-polls
+// /d/{name}/chat/messages?after=<id> for new messages as JSON.
+const (
+	maxChatMessages = 200
+	maxChatText     = 2000
+	maxChatName     = 32
+	// chatPollTimeout is how long a poll waits for a new message, well
+	// within the server's write timeout
+	chatPollTimeout = 30 * time.Second
+	// chatCSP lets the chat page run its own script and poll for messages
+	chatCSP = "default-src 'none'; script-src 'self'; connect-src 'self'; style-src 'self'; " +
+		"form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+)
+
+// chatRooms holds the chat room of every share that has one by share name.
+type chatRooms struct {
+	sync.Mutex
+	rooms map[string]*chatRoom
+	// done is closed on shutdown to end polls waiting for messages
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type chatRoom struct {
+	messages []*chatMessage
+	lastID   int
+	// notify is closed and replaced whenever a message is posted
+	notify chan struct{}
+}
+
+// chatMessage keeps its text in byte slices so it can be wiped.
+type chatMessage struct {
+	id       int
+	name     []byte
+	text     []byte
+	uploader bool
+	sent     time.Time
+}
+
+// chatView is a message as it is shown on the page and sent to polls.
+type chatView struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Text     string `json:"text"`
+	Uploader bool   `json:"uploader"`
+	// Time is in UTC so the server's time zone isn't given away
+	Time string `json:"time"`
+}
+
+func newChatRooms() *chatRooms {
+	return &chatRooms{rooms: make(map[string]*chatRoom), done: make(chan struct{})}
+}
+
+// post adds a message to the share's room, creating the room if needed
+// and dropping the oldest message once the room is full. Nothing is
+// posted once the share has been destroyed, its room is already gone.
+func (c *chatRooms) post(share *onion_buffer.OnionBuffer, name, text string, uploader bool) {
+	c.Lock()
+	defer c.Unlock()
+	if share.Destroyed() {
+		return
+	}
+	room, ok := c.rooms[share.Name]
+	if !ok {
+		room = &chatRoom{notify: make(chan struct{})}
+		c.rooms[share.Name] = room
+	}
+	room.lastID++
+	room.messages = append(room.messages, &chatMessage{
+		id:       room.lastID,
+		name:     []byte(name),
+		text:     []byte(text),
+		uploader: uploader,
+		sent:     time.Now(),
+	})
+	if len(room.messages) > maxChatMessages {
+		room.messages[0].wipe()
+		room.messages = room.messages[1:]
+	}
+	close(room.notify)
+	room.notify = make(chan struct{})
+}
+
+// since returns the share's messages posted after the message with ID
+// after, the ID of the latest message and a channel closed when the next
+// one is posted, or straight away once the share has been destroyed.
+func (c *chatRooms) since(share *onion_buffer.OnionBuffer, after int) ([]chatView, int, <-chan struct{}) {
+	c.Lock()
+	defer c.Unlock()
+	if share.Destroyed() {
+		gone := make(chan struct{})
+		close(gone)
+		return []chatView{}, 0, gone
+	}
+	room, ok := c.rooms[share.Name]
+	if !ok {
+		// Post creates the room, so wait on one to be ready
+		room = &chatRoom{notify: make(chan struct{})}
+		c.rooms[share.Name] = room
+	}
+	views := make([]chatView, 0)
+	for _, msg := range room.messages {
+		if msg.id > after {
+			views = append(views, msg.view())
+		}
+	}
+	return views, room.lastID, room.notify
+}
+
+// remove wipes the room of a share that has left the store.
+func (c *chatRooms) remove(share string) {
+	c.Lock()
+	defer c.Unlock()
+	if room, ok := c.rooms[share]; ok {
+		room.wipe()
+		delete(c.rooms, share)
+	}
+}
+
+// destroyAll wipes every room.
+func (c *chatRooms) destroyAll() {
+	c.Lock()
+	defer c.Unlock()
+	for share, room := range c.rooms {
+		room.wipe()
+		delete(c.rooms, share)
+	}
+}
+
+// stop ends every poll waiting for messages.
+func (c *chatRooms) stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+func (room *chatRoom) wipe() {
+	for _, msg := range room.messages {
+		msg.wipe()
+	}
+	room.messages = nil
+	// Wake polls so they find the room gone
+	close(room.notify)
+	room.notify = make(chan struct{})
+}
+
+func (msg *chatMessage) wipe() {
+	onion_buffer.Wipe(msg.name)
+	onion_buffer.Wipe(msg.text)
+}
+
+func (msg *chatMessage) view() chatView {
+	return chatView{
+		ID:       msg.id,
+		Name:     string(msg.name),
+		Text:     string(msg.text),
+		Uploader: msg.uploader,
+		Time:     msg.sent.UTC().Format("15:04 MST"),
+	}
+}
+
+// chatURL returns the link to a share's chat room.
+func (ob *onionbox) chatURL(name string) string {
+	return ob.shareURL(name) + "/chat"
+}
+
+func (ob *onionbox) chatPage(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.lookup(w, r, http.Error)
+	if oBuffer == nil {
+		return
+	}
+	key := r.URL.Query().Get("key")
+	uploader := key != "" && oBuffer.ValidToken(key)
+	switch r.Method {
+	case http.MethodGet:
+		csrf, err := ob.createCSRF(w, r)
+		if err != nil {
+			ob.logf("Error creating CSRF token: %v", err)
+			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+			return
+		}
+		// Parse template
+		t, err := template.New("chat").Parse(templates.ChatHTML)
+		if err != nil {
+			ob.logf("Error loading template: %v", err)
+			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+			return
+		}
+		// Execute template
+		messages, last, _ := ob.chats.since(oBuffer, 0)
+		data := struct {
+			Messages []chatView
+			Last     int
+			PollURL  string
+			Uploader bool
+			Token    string
+		}{messages, last, "/d/" + oBuffer.Name + "/chat/messages", uploader, csrf}
+		w.Header().Set("Content-Security-Policy", chatCSP)
+		if err := t.Execute(w, data); err != nil {
+			ob.logf("Error executing template: %v", err)
+			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPost:
+		if !ob.parseSmallForm(w, r) {
+			return
+		}
+		if !ob.validCSRF(r, r.PostFormValue("token")) {
+			ob.forbidCSRF(w)
+			return
+		}
+		text := strings.TrimSpace(r.PostFormValue("text"))
+		if text == "" || utf8.RuneCountInString(text) > maxChatText {
+			http.Error(w, "Messages must be between 1 and 2000 characters.", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.PostFormValue("name"))
+		if name == "" {
+			name = "anonymous"
+		}
+		if utf8.RuneCountInString(name) > maxChatName {
+			http.Error(w, "Names can't be longer than 32 characters.", http.StatusBadRequest)
+			return
+		}
+		ob.chats.post(oBuffer, name, text, uploader)
+		// The script posts in the background, forms go back to the room
+		if r.Header.Get("Accept") == "application/json" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	default:
+		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+	}
+}
+
+// chatMessages long-polls for the messages after the one given by the
+// after query parameter.
+func (ob *onionbox) chatMessages(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.lookup(w, r, ob.apiError)
+	if oBuffer == nil {
+		return
+	}
+	after, err := strconv.Atoi(r.URL.Query().Get("after"))
+	if err != nil || after < 0 {
+		ob.apiError(w, "Invalid after parameter.", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), chatPollTimeout)
+	defer cancel()
+	messages, last, notify := ob.chats.since(oBuffer, after)
+	for len(messages) == 0 {
+		select {
+		case <-notify:
+		case <-ctx.Done():
+		case <-ob.chats.done:
+		}
+		if ctx.Err() != nil || isDone(ob.chats.done) || oBuffer.Destroyed() {
+			break
+		}
+		messages, last, notify = ob.chats.since(oBuffer, after)
+	}
+	ob.writeJSON(w, http.StatusOK, struct {
+		Messages []chatView `json:"messages"`
+		Last     int        `json:"last"`
+	}{messages, last})
+}
+
+// isDone reports whether done has been closed.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
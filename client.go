@@ -0,0 +1,483 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The client fetches shares and uploads files from the command line,
+// dialing onion addresses through an embedded Tor and anything else, such
+// as a server run with -local, directly.
+//
+//	onionbox get [flags] <share url>
+//	onionbox put [flags] <onion> <files...>
+//
+// get downloads through the API, sending the password of an encrypted
+// share in the Onionbox-Password header. The zip is written to a .part
+// file that is picked up again after a dropped connection, in the same run
+// or the next, and is only renamed once its checksums are verified. put
+// sends each file as a tus resumable upload, carrying on from the offset
+// the server reports after a dropped connection, and prints a share link
+// for each.
+const (
+	// putChunkSize is the most sent in one PATCH, small enough to get
+	// through a slow circuit before the server's read timeout
+	putChunkSize = 1 << 20
+	// clientStartTimeout bounds how long Tor gets to bootstrap
+	clientStartTimeout = 3 * time.Minute
+)
+
+// dialer connects the client to an onionbox server.
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	Close() error
+}
+
+// directDialer dials servers that aren't onion services without Tor.
+type directDialer struct {
+	net.Dialer
+}
+
+func (d *directDialer) Close() error {
+	return nil
+}
+
+// client talks to a single onionbox server.
+type client struct {
+	base    string
+	http    *http.Client
+	dialer  dialer
+	retries int
+}
+
+// statusError is an error response from the server. Unlike a dropped
+// connection, trying again won't help.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s (%d %s)", e.msg, e.code, http.StatusText(e.code))
+}
+
+// runClient runs the get or put subcommand, returning the process exit
+// code.
+func runClient(cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	retries := fs.Int("retries", 5, "times to resume after a dropped connection")
+	var out string
+	var opts shareOptions
+	if cmd == "get" {
+		fs.Usage = subcommandUsage(fs, "get [flags] <share url>")
+		fs.StringVar(&out, "o", "", "file to save the zip to, <name>.zip by default")
+	} else {
+		fs.Usage = subcommandUsage(fs, "put [flags] <onion> <files...>")
+		opts.flags(fs)
+	}
+	fs.Parse(args)
+	if (cmd == "get" && fs.NArg() != 1) || (cmd == "put" && fs.NArg() < 2) {
+		fs.Usage()
+		return 2
+	}
+	c, err := newClient(fs.Arg(0), *retries)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to onionbox: %v\n", err)
+		return 1
+	}
+	defer c.close()
+	if cmd == "get" {
+		err = c.get(fs.Arg(0), out)
+	} else {
+		opts.paths = fs.Args()[1:]
+		err = c.putAll(opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// newClient returns a client for the server at target, a URL or onion
+// address, starting Tor if it is an onion service.
+func newClient(target string, retries int) (*client, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	var d dialer = &directDialer{}
+	if strings.HasSuffix(u.Hostname(), ".onion") {
+		fmt.Fprintln(os.Stderr, "Starting Tor, please wait...")
+		ctx, cancel := context.WithTimeout(context.Background(), clientStartTimeout)
+		defer cancel()
+		if d, err = newTorDialer(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &client{
+		base:    u.Scheme + "://" + u.Host,
+		http:    &http.Client{Transport: &http.Transport{DialContext: d.DialContext}},
+		dialer:  d,
+		retries: retries,
+	}, nil
+}
+
+func (c *client) close() {
+	if err := c.dialer.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error stopping Tor: %v\n", err)
+	}
+}
+
+// retry calls fn until it succeeds, the server refuses the request or the
+// retries run out. fn resumes from wherever the last attempt got to.
+func (c *client) retry(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		// A busy server asks to be tried again later, anything else it
+		// refuses is final
+		if se, refused := err.(*statusError); refused && se.code != http.StatusTooManyRequests || attempt >= c.retries {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Interrupted (%v), resuming...\n", err)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+// do sends req, turning error responses into a statusError.
+func (c *client) do(req *http.Request, okCodes ...int) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range okCodes {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxFormValue))
+	msg := strings.TrimSpace(string(body))
+	var apiErr apiErrorBody
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+		msg = apiErr.Error.Message
+	}
+	return nil, &statusError{resp.StatusCode, msg}
+}
+
+// get downloads the share at shareURL to out.
+func (c *client) get(shareURL, out string) error {
+	u, err := url.Parse(shareURL)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(u.Path, "/d/")
+	if !validShareID(name) {
+		return fmt.Errorf("%s is not a share link", shareURL)
+	}
+	var upload apiUpload
+	err = c.retry(func() error {
+		req, err := http.NewRequest(http.MethodGet, c.base+apiPath+uploadsPath+"/"+name, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return json.NewDecoder(resp.Body).Decode(&upload)
+	})
+	if err != nil {
+		return err
+	}
+	pass := ""
+	if upload.Encrypted {
+		if pass, err = passphrase(sharePasswordEnv, "Password: ", false); err != nil {
+			return err
+		}
+	}
+	if out == "" {
+		out = name + ".zip"
+	}
+	part, err := os.OpenFile(out+".part", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	contentURL := c.base + apiPath + uploadsPath + "/" + name + "/content"
+	if err := c.retry(func() error { return c.fetch(part, contentURL, pass, upload.Checksum) }); err != nil {
+		return err
+	}
+	// Only an unencrypted share is served as stored, encrypted ones are
+	// checked by onionbox as it decrypts them
+	if !upload.Encrypted {
+		if err := verifyMD5(part, upload.Checksum); err != nil {
+			os.Remove(part.Name())
+			return err
+		}
+	}
+	if err := verifyZip(part); err != nil {
+		os.Remove(part.Name())
+		return err
+	}
+	if err := part.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(part.Name(), out); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %s\n", out)
+	return nil
+}
+
+// fetch downloads the rest of the content at contentURL into part,
+// starting over if the share changed since part was begun.
+func (c *client) fetch(part *os.File, contentURL, pass, checksum string) error {
+	offset, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, contentURL, nil)
+	if err != nil {
+		return err
+	}
+	if pass != "" {
+		req.Header.Set(passwordHeader, pass)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", fmt.Sprintf("%q", checksum))
+	}
+	resp, err := c.do(req, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Everything arrived before the connection dropped
+		return nil
+	case http.StatusOK:
+		if err := part.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := part.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return errors.New("server resumed from the wrong offset")
+		}
+	}
+	_, err = io.Copy(part, resp.Body)
+	return err
+}
+
+// verifyMD5 checks f against the checksum onionbox keeps of a share.
+func verifyMD5(f *os.File, checksum string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return errors.New("checksum mismatch, the download is corrupt")
+	}
+	return nil
+}
+
+// verifyZip checks the CRC of every file in the zip f.
+func verifyZip(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("the download is not a valid zip: %v", err)
+	}
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s in the download is corrupt: %v", zf.Name, err)
+		}
+	}
+	return nil
+}
+
+// putAll uploads every file in opts.paths as its own share.
+func (c *client) putAll(opts shareOptions) error {
+	if opts.limit < 0 || opts.expire < 0 {
+		return errInvalidUpdate
+	}
+	metadata := make(map[string]string)
+	if opts.encrypt {
+		pass, err := passphrase(sharePasswordEnv, "Share password: ", true)
+		if err != nil {
+			return err
+		}
+		metadata["password"] = pass
+	}
+	if opts.limit > 0 {
+		metadata["download_limit"] = strconv.Itoa(opts.limit)
+	}
+	if opts.expire > 0 {
+		metadata["expiration_time"] = strconv.Itoa(opts.expire)
+	}
+	for _, path := range opts.paths {
+		shareURL, manageURL, err := c.put(path, metadata)
+		if err != nil {
+			return fmt.Errorf("uploading %s: %v", path, err)
+		}
+		fmt.Printf("%s: %s\n", path, shareURL)
+		// The management link is only sent with the final response
+		if manageURL != "" {
+			fmt.Printf("Manage it with: %s\n", manageURL)
+		}
+	}
+	return nil
+}
+
+// put sends the file at path as a resumable upload, returning its share
+// and management links.
+func (c *client) put(path string, metadata map[string]string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", "", errors.New("only regular files can be uploaded")
+	}
+	pairs := []string{"filename " + base64.StdEncoding.EncodeToString([]byte(filepath.Base(path)))}
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	var location string
+	var progress tusProgress
+	err = c.retry(func() error {
+		req, err := http.NewRequest(http.MethodPost, c.base+uploadsPath, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Length", strconv.FormatInt(info.Size(), 10))
+		req.Header.Set("Upload-Metadata", strings.Join(pairs, ","))
+		resp, err := c.do(req, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		location = c.base + resp.Header.Get("Location")
+		progress, err = readProgress(resp.Header)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	// Send the file a chunk at a time, asking where the server got to
+	// after a dropped connection
+	for progress.shareURL == "" {
+		err := c.retry(func() error {
+			n := info.Size() - progress.offset
+			if n > putChunkSize {
+				n = putChunkSize
+			}
+			req, err := http.NewRequest(http.MethodPatch, location, io.NewSectionReader(f, progress.offset, n))
+			if err != nil {
+				return err
+			}
+			req.ContentLength = n
+			req.Header.Set("Tus-Resumable", tusVersion)
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+			req.Header.Set("Upload-Offset", strconv.FormatInt(progress.offset, 10))
+			// A conflict carries the offset the server actually has
+			resp, err := c.do(req, http.StatusNoContent, http.StatusConflict)
+			if err != nil {
+				if _, refused := err.(*statusError); !refused {
+					if head, headErr := c.uploadProgress(location); headErr == nil {
+						progress = head
+					}
+				}
+				return err
+			}
+			resp.Body.Close()
+			progress, err = readProgress(resp.Header)
+			return err
+		})
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return progress.shareURL, progress.manageURL, nil
+}
+
+// tusProgress is what the server reports about a resumable upload.
+type tusProgress struct {
+	offset int64
+	// shareURL and manageURL are only set once the upload is complete
+	shareURL  string
+	manageURL string
+}
+
+func readProgress(header http.Header) (tusProgress, error) {
+	offset, err := strconv.ParseInt(header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return tusProgress{}, &statusError{http.StatusBadGateway, "invalid Upload-Offset from server"}
+	}
+	return tusProgress{offset, header.Get("Onionbox-Share-Url"), header.Get("Onionbox-Manage-Url")}, nil
+}
+
+// uploadProgress asks the server how much of the upload at location it
+// has.
+func (c *client) uploadProgress(location string) (tusProgress, error) {
+	req, err := http.NewRequest(http.MethodHead, location, nil)
+	if err != nil {
+		return tusProgress{}, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return tusProgress{}, err
+	}
+	resp.Body.Close()
+	return readProgress(resp.Header)
+}
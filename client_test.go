@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"onionbox/onion_buffer"
+)
+
+// serveTestOnionbox serves a new onionbox through a localPublisher, as
+// -local does, and returns it with a client for its address.
+func serveTestOnionbox(t *testing.T) (*onionbox, *client, func()) {
+	t.Helper()
+	ob := newTestOnionbox(onion_buffer.NewStore())
+	pub := &localPublisher{address: "127.0.0.1:0"}
+	ln, baseURL, err := pub.Listen(context.Background())
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ob.baseURL = baseURL
+	srv := &http.Server{Handler: ob.routes()}
+	go srv.Serve(ln)
+	c, err := newClient(baseURL, 0)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	return ob, c, func() {
+		srv.Close()
+		pub.Close()
+		c.close()
+		ob.destroy()
+	}
+}
+
+// readTestZip returns the contents of every file in the zip at path.
+func readTestZip(t *testing.T, path string) map[string]string {
+	t.Helper()
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer zr.Close()
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s in zip: %v", f.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading %s in zip: %v", f.Name, err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestClientGetFormUpload(t *testing.T) {
+	ob, c, stop := serveTestOnionbox(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "onionbox-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := map[string]string{"a.txt": "first file", "b.txt": "second file"}
+	body, contentType := multipartUpload(t, map[string]string{"limit_downloads": "on", "download_limit": "1"}, want)
+	req, err := http.NewRequest(http.MethodPost, ob.baseURL+apiPath+uploadsPath, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(apiHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("uploading: %v", err)
+	}
+	var upload apiUpload
+	err = json.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload returned %d: %v", resp.StatusCode, err)
+	}
+
+	out := filepath.Join(dir, "share.zip")
+	if err := c.get(upload.URL, out); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got := readTestZip(t, out)
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s is %q, want %q", name, got[name], content)
+		}
+	}
+	// The only download allowed has been made
+	err = c.get(upload.URL, filepath.Join(dir, "again.zip"))
+	if se, ok := err.(*statusError); !ok || se.code != http.StatusNotFound {
+		t.Errorf("second get of a share limited to one download returned %v, want 404", err)
+	}
+}
+
+func TestClientPutThenGet(t *testing.T) {
+	_, c, stop := serveTestOnionbox(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "onionbox-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Keep key derivation cheap for the encrypted share
+	defer func(params onion_buffer.KDFParams) { onion_buffer.DefaultKDFParams = params }(onion_buffer.DefaultKDFParams)
+	onion_buffer.DefaultKDFParams = onion_buffer.KDFParams{Time: 1, Memory: 64, Threads: 1}
+	os.Setenv(sharePasswordEnv, "correct horse")
+	defer os.Unsetenv(sharePasswordEnv)
+
+	// Large enough to take several PATCH requests
+	content := make([]byte, 3*putChunkSize+123)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	path := filepath.Join(dir, "data.bin")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"plain", nil},
+		{"encrypted", map[string]string{"password": "correct horse"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shareURL, _, err := c.put(path, tt.metadata)
+			if err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			out := filepath.Join(dir, tt.name+".zip")
+			if err := c.get(shareURL, out); err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			got := readTestZip(t, out)
+			if len(got) != 1 || got["data.bin"] != string(content) {
+				t.Errorf("zip holds %d files, data.bin matches: %v", len(got), got["data.bin"] == string(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// With v3 client authorization only Tor clients holding one of the
+// service's x25519 client keys can fetch its descriptor, so nobody else can
+// connect even knowing the address. Authorized clients are kept in a
+// directory of Tor authorized_clients files, <name>.auth, each holding the
+// line descriptor:x25519:<base32 public key>. The private half is only
+// printed once, as the line the client adds to its .auth_private file.
+const authFileSuffix = ".auth"
+
+var (
+	authKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+	clientNameReg   = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// clientCredential is a newly created client whose private key still has
+// to be handed out.
+type clientCredential struct {
+	name    string
+	private [32]byte
+}
+
+// loadAuthorizedClients reads the authorized clients in dir, returning
+// the contents of each client's .auth file by name.
+func loadAuthorizedClients(dir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]string)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), authFileSuffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		line := strings.TrimSpace(string(data))
+		key := strings.TrimPrefix(line, "descriptor:x25519:")
+		if b, err := authKeyEncoding.DecodeString(key); err != nil || len(b) != 32 || key == line {
+			return nil, fmt.Errorf("%s is not a v3 client authorization file", f.Name())
+		}
+		clients[strings.TrimSuffix(f.Name(), authFileSuffix)] = line
+	}
+	return clients, nil
+}
+
+// createClient generates an x25519 keypair for a new client and adds the
+// public key to dir.
+func createClient(dir, name string) (*clientCredential, error) {
+	if !clientNameReg.MatchString(name) {
+		return nil, fmt.Errorf("invalid client name %q, use up to 64 letters, digits, - or _", name)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	cred := &clientCredential{name: name}
+	if _, err := rand.Read(cred.private[:]); err != nil {
+		return nil, err
+	}
+	// Clamp the private key as x25519 expects
+	cred.private[0] &= 248
+	cred.private[31] &= 127
+	cred.private[31] |= 64
+	var public [32]byte
+	curve25519.ScalarBaseMult(&public, &cred.private)
+	path := filepath.Join(dir, name+authFileSuffix)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "descriptor:x25519:%s\n", authKeyEncoding.EncodeToString(public[:])); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return cred, nil
+}
+
+// authPrivateLine returns the line a client adds to its .auth_private file
+// to connect to the onion service serviceID.
+func (cred *clientCredential) authPrivateLine(serviceID string) string {
+	return fmt.Sprintf("%s:descriptor:x25519:%s", serviceID, authKeyEncoding.EncodeToString(cred.private[:]))
+}
+
+// serviceDirRoot is where the directory handing an authorized service's
+// key to Tor is created if it exists. It is memory backed, so the key
+// never reaches the disk.
+const serviceDirRoot = "/dev/shm"
+
+// serviceDirInMemory reports whether serviceDirRoot can be used.
+func serviceDirInMemory() bool {
+	info, err := os.Stat(serviceDirRoot)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"time"
+)
+
+// Forms are protected from cross-site request forgery with tokens bound to
+// a session cookie. A token is the expiry time followed by an HMAC of the
+// session ID and that expiry, so it can't be forged without the server's
+// key, replayed from another session or used once it is stale.
+const (
+	sessionCookie = "onionbox_session"
+	csrfTTL       = time.Hour
+)
+
+// createCSRF returns a form token for the client's session, starting a new
+// session if it doesn't have one yet.
+func (ob *onionbox) createCSRF(w http.ResponseWriter, r *http.Request) (string, error) {
+	session := ""
+	if cookie, err := r.Cookie(sessionCookie); err == nil && validSessionID(cookie.Value) {
+		session = cookie.Value
+	} else {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		session = base64.RawURLEncoding.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    session,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	token := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(token, uint64(time.Now().Add(csrfTTL).Unix()))
+	token = append(token, ob.csrfMAC(session, token[:8])...)
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// validCSRF reports whether token was issued to the request's session and
+// hasn't expired.
+func (ob *onionbox) validCSRF(r *http.Request, token string) bool {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || !validSessionID(cookie.Value) {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	if time.Now().After(expiry) {
+		return false
+	}
+	return hmac.Equal(b[8:], ob.csrfMAC(cookie.Value, b[:8]))
+}
+
+func (ob *onionbox) csrfMAC(session string, expiry []byte) []byte {
+	mac := hmac.New(sha256.New, ob.csrfKey)
+	mac.Write([]byte(session))
+	mac.Write(expiry)
+	return mac.Sum(nil)
+}
+
+// validSessionID reports whether id looks like a session ID we issued.
+func validSessionID(id string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && subtle.ConstantTimeEq(int32(len(b)), 16) == 1
+}
+
+// forbidCSRF rejects a form submitted without a valid token.
+func (ob *onionbox) forbidCSRF(w http.ResponseWriter) {
+	ob.logf("Rejected form with missing or invalid CSRF token")
+	http.Error(w, "Invalid or expired form, please refresh the page and try again.", http.StatusForbidden)
+}
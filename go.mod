@@ -1,11 +1,11 @@
 module onionbox
 
 require (
-	github.com/Pallinder/go-randomdata v1.1.0
 	github.com/cretz/bine v0.1.0
 	github.com/ipsn/go-libtor v0.0.0-20190118221740-0b3507cf026e
 	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc // indirect
+	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc
 	golang.org/x/net v0.0.0-20190119204137-ed066c81e75e // indirect
+	golang.org/x/sys v0.0.0-20190204203706-41f3e6584952 // indirect
 	golang.org/x/text v0.3.0 // indirect
 )
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"onionbox/onion_buffer"
+	"onionbox/templates"
+)
+
+// bufferUpdate holds changes to an upload's limits, nil fields are left
+// as they are.
+type bufferUpdate struct {
+	// DownloadLimit is the new download limit, 0 for no limit
+	DownloadLimit *int `json:"download_limit"`
+	// ExpirationTime is the minutes from now until the link expires, 0
+	// for never
+	ExpirationTime *int `json:"expiration_time"`
+}
+
+var errInvalidUpdate = errors.New("download limit and expiration time can't be negative")
+
+// manageURL returns the link the uploader uses to manage a buffer. Every
+// upload comes with a secret management token that lets the uploader see
+// its downloads, change its expiry and download limit, or destroy it early.
+// The token is part of this link and is sent as a bearer token to the API.
+func (ob *onionbox) manageURL(name, token string) string {
+	return fmt.Sprintf("%s/manage/%s?key=%s", ob.baseURL, name, url.QueryEscape(token))
+}
+
+func (ob *onionbox) manage(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.lookup(w, r, http.Error)
+	if oBuffer == nil {
+		return
+	}
+	// Don't tell apart a wrong key from a missing buffer
+	if !oBuffer.ValidToken(r.URL.Query().Get("key")) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		csrf, err := ob.createCSRF(w, r)
+		if err != nil {
+			ob.logf("Error creating CSRF token: %v", err)
+			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+			return
+		}
+		// Parse template
+		t, err := template.New("manage").Parse(templates.ManageHTML)
+		if err != nil {
+			ob.logf("Error loading template: %v", err)
+			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+			return
+		}
+		// Execute template
+		data := struct {
+			Upload  apiUpload
+			ChatURL string
+			Token   string
+		}{ob.describe(oBuffer), "", csrf}
+		// The key marks the uploader's messages in the chat
+		if ob.chat {
+			data.ChatURL = ob.chatURL(oBuffer.Name) + "?key=" + url.QueryEscape(r.URL.Query().Get("key"))
+		}
+		if err := t.Execute(w, data); err != nil {
+			ob.logf("Error executing template: %v", err)
+			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPost:
+		if !ob.parseSmallForm(w, r) {
+			return
+		}
+		// The key travels in the URL, so read the token from the body only
+		if !ob.validCSRF(r, r.PostFormValue("token")) {
+			ob.forbidCSRF(w)
+			return
+		}
+		if r.PostFormValue("action") == "destroy" {
+			if err := ob.store.Delete(oBuffer); err != nil {
+				ob.logf("Error deleting onion file from store: %v", err)
+				http.Error(w, "Error destroying files.", http.StatusInternalServerError)
+				return
+			}
+			ob.logf("Upload %s destroyed by its uploader", oBuffer.Name)
+			if _, err := w.Write([]byte("Files destroyed. The download link no longer works.")); err != nil {
+				ob.logf("Error writing to client: %v", err)
+			}
+			return
+		}
+		var update bufferUpdate
+		var err error
+		if update.DownloadLimit, err = optionalInt(r.PostFormValue("download_limit")); err != nil {
+			http.Error(w, "Invalid download limit.", http.StatusBadRequest)
+			return
+		}
+		if update.ExpirationTime, err = optionalInt(r.PostFormValue("expiration_time")); err != nil {
+			http.Error(w, "Invalid expiration time.", http.StatusBadRequest)
+			return
+		}
+		if err := ob.updateBuffer(oBuffer, update); err != nil {
+			http.Error(w, "Download limit and expiration time can't be negative.", http.StatusBadRequest)
+			return
+		}
+		// Back to the page showing the new limits
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	default:
+		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+	}
+}
+
+// updateBuffer applies an uploader's changes to a buffer.
+func (ob *onionbox) updateBuffer(oBuffer *onion_buffer.OnionBuffer, update bufferUpdate) error {
+	if (update.DownloadLimit != nil && *update.DownloadLimit < 0) ||
+		(update.ExpirationTime != nil && *update.ExpirationTime < 0) {
+		return errInvalidUpdate
+	}
+	if update.DownloadLimit != nil {
+		oBuffer.SetDownloadLimit(*update.DownloadLimit)
+	}
+	if update.ExpirationTime != nil {
+		var expiresAt time.Time
+		if *update.ExpirationTime > 0 {
+			expiresAt = time.Now().Add(time.Duration(*update.ExpirationTime) * time.Minute)
+		}
+		ob.store.SetExpiry(oBuffer, expiresAt)
+	}
+	ob.logf("Upload %s updated by its uploader", oBuffer.Name)
+	return nil
+}
+
+// optionalInt parses a form value that may be left empty.
+func optionalInt(value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
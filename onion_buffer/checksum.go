@@ -13,6 +13,7 @@ const chunkSize = 1024
 
 func (of *OnionBuffer) GetChecksum() (string, error) {
 	of.Lock()
+	defer of.Unlock()
 	var count int
 	var err error
 	hash := md5.New()
@@ -36,7 +37,6 @@ func (of *OnionBuffer) GetChecksum() (string, error) {
 	} else {
 		err = nil
 	}
-	of.Unlock()
 	hashInBytes := hash.Sum(nil)[:16]
 	return hex.EncodeToString(hashInBytes), nil
 }
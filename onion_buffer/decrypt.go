@@ -1,25 +1,17 @@
 package onion_buffer
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
+	"io/ioutil"
 )
 
+// Decrypt opens data sealed by Encrypt, reading the key derivation
+// parameters from its header. Prefer NewDecryptReader for large data.
 func Decrypt(data []byte, passphrase string) ([]byte, error) {
-	key := []byte(createHash(passphrase))
-	block, err := aes.NewCipher(key)
+	dr, err := NewDecryptReader(bytes.NewReader(data), passphrase)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, err
-	}
-	return plaintext, nil
+	defer dr.Close()
+	return ioutil.ReadAll(dr)
 }
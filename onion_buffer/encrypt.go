@@ -1,22 +1,22 @@
 package onion_buffer
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"io"
+	"bytes"
 )
 
+// Encrypt seals data as a segmented stream, see NewEncryptWriter. Prefer
+// the writer for large data to avoid holding the plaintext in memory.
 func Encrypt(data []byte, passphrase string) ([]byte, error) {
-	block, _ := aes.NewCipher([]byte(createHash(passphrase)))
-	gcm, err := cipher.NewGCM(block)
+	buffer := new(bytes.Buffer)
+	ew, err := NewEncryptWriter(buffer, passphrase)
 	if err != nil {
 		return nil, err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	if _, err := ew.Write(data); err != nil {
 		return nil, err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	if err := ew.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
 }
@@ -0,0 +1,62 @@
+package onion_buffer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// EvictionPolicy decides which buffers are evicted first when a store
+// runs out of room for a new upload.
+type EvictionPolicy int
+
+const (
+	// EvictNone rejects uploads that don't fit instead of evicting.
+	EvictNone EvictionPolicy = iota
+	// EvictOldest evicts the oldest buffers first.
+	EvictOldest
+	// EvictExpiring evicts expired buffers first, then those closest to
+	// expiring. Buffers that never expire are evicted last, oldest first.
+	EvictExpiring
+)
+
+var evictionNames = map[EvictionPolicy]string{
+	EvictNone:     "none",
+	EvictOldest:   "oldest",
+	EvictExpiring: "expiring",
+}
+
+// ParseEvictionPolicy returns the policy with the given name as used on
+// the command line.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for policy, n := range evictionNames {
+		if n == name {
+			return policy, nil
+		}
+	}
+	return EvictNone, fmt.Errorf("unknown eviction policy %q, must be one of: none, oldest, expiring", name)
+}
+
+func (p EvictionPolicy) String() string {
+	if name, ok := evictionNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+}
+
+// sort orders buffers so the ones to evict first come first.
+func (p EvictionPolicy) sort(buffers []*OnionBuffer) {
+	sortByAge(buffers)
+	if p != EvictExpiring {
+		return
+	}
+	sort.SliceStable(buffers, func(i, j int) bool {
+		a, b := buffers[i].ExpiresAt, buffers[j].ExpiresAt
+		switch {
+		case a.IsZero():
+			return false
+		case b.IsZero():
+			return true
+		}
+		return a.Before(b)
+	})
+}
@@ -1,12 +1,35 @@
 package onion_buffer
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"golang.org/x/crypto/argon2"
 )
 
-func createHash(key string) string {
-	hasher := md5.New()
-	hasher.Write([]byte(key))
-	return hex.EncodeToString(hasher.Sum(nil))
+const (
+	keySize  = 32
+	saltSize = 16
+)
+
+// KDFParams are the Argon2id cost parameters used to turn a password into
+// an encryption key. They are stored in the header of every encrypted
+// buffer so they can be raised without breaking existing buffers.
+type KDFParams struct {
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the amount of memory used in KiB
+	Memory uint32
+	// Threads is the degree of parallelism
+	Threads uint8
+}
+
+// DefaultKDFParams are used by Encrypt. They follow the recommendations
+// of the Argon2 RFC draft for interactive use.
+var DefaultKDFParams = KDFParams{
+	Time:    1,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// deriveKey derives an AES-256 key from the password with Argon2id.
+func deriveKey(passphrase string, salt []byte, params KDFParams) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, keySize)
 }
@@ -0,0 +1,79 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Encrypted buffers start with a versioned header so the format can
+// evolve:
+//
+//	magic   [4]byte  "obx" followed by the format version
+//	time    uint32   Argon2id passes
+//	memory  uint32   Argon2id memory in KiB
+//	threads uint8    Argon2id parallelism
+//	salt    [16]byte
+//	chunk   uint32   plaintext bytes per chunk
+//	prefix  [7]byte  random nonce prefix
+//
+// The header is authenticated as additional data by the cipher. Only the
+// segmented stream, version 2, can be read; the whole-buffer formats that
+// came before it are refused.
+const formatStream = 2
+
+var headerMagic = []byte("obx")
+
+const (
+	saltEnd          = 4 + 4 + 4 + 1 + saltSize
+	headerStreamSize = saltEnd + 4 + noncePrefixSize
+)
+
+var errHeader = errors.New("invalid encryption header")
+
+type header struct {
+	version     byte
+	params      KDFParams
+	salt        []byte
+	chunkSize   uint32
+	noncePrefix []byte
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, headerStreamSize)
+	copy(b, headerMagic)
+	b[3] = h.version
+	binary.BigEndian.PutUint32(b[4:8], h.params.Time)
+	binary.BigEndian.PutUint32(b[8:12], h.params.Memory)
+	b[12] = h.params.Threads
+	copy(b[13:saltEnd], h.salt)
+	binary.BigEndian.PutUint32(b[saltEnd:], h.chunkSize)
+	copy(b[saltEnd+4:], h.noncePrefix)
+	return b
+}
+
+// parseHeader reads the header at the start of data.
+func parseHeader(data []byte) (*header, error) {
+	if len(data) < headerStreamSize || !bytes.Equal(data[:len(headerMagic)], headerMagic) {
+		return nil, errHeader
+	}
+	h := &header{version: data[3]}
+	if h.version != formatStream {
+		return nil, errHeader
+	}
+	h.params = KDFParams{
+		Time:    binary.BigEndian.Uint32(data[4:8]),
+		Memory:  binary.BigEndian.Uint32(data[8:12]),
+		Threads: data[12],
+	}
+	if h.params.Time == 0 || h.params.Threads == 0 {
+		return nil, errHeader
+	}
+	h.salt = data[13:saltEnd]
+	h.chunkSize = binary.BigEndian.Uint32(data[saltEnd:])
+	h.noncePrefix = data[saltEnd+4 : headerStreamSize]
+	if h.chunkSize == 0 || h.chunkSize > maxChunkSize {
+		return nil, errHeader
+	}
+	return h, nil
+}
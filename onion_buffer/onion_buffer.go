@@ -1,10 +1,8 @@
 package onion_buffer
 
 import (
-	"archive/zip"
-	"bufio"
 	"bytes"
-	"io"
+	"errors"
 	"sync"
 	"syscall"
 	"time"
@@ -22,43 +20,230 @@ type OnionBuffer struct {
 	DownloadsLimited bool
 	CreatedAt        time.Time
 	ExpiresAt        time.Time
+	FailedAttempts   int
+	readers          int
+	transfers        int
+	delivered        int64
+	destroyed        bool
+	attempting       bool
+	nextAttempt      time.Time
+	tokenHash        []byte
 }
 
+const (
+	// Backoff after the first wrong password, doubled for every further
+	// consecutive failure up to maxAttemptBackoff
+	attemptBackoff    = time.Second
+	maxAttemptBackoff = 5 * time.Minute
+)
+
+// ErrDestroyed is returned when reading a buffer that has been destroyed.
+var ErrDestroyed = errors.New("buffer has been destroyed")
+
+// Destroy securely wipes the buffer. Every byte of the backing array is
+// overwritten with zeros before the memory is unlocked and the reference
+// dropped, so no copy of the contents is left behind by the buffer. If
+// readers are still open the wipe happens when the last one is closed.
 func (of *OnionBuffer) Destroy() error {
 	of.Lock()
-	var err error
-	buffer := bytes.NewBuffer(of.Bytes)
-	zWriter := zip.NewWriter(buffer)
-	reader := bufio.NewReader(bytes.NewReader(of.Bytes))
-	chunk := make([]byte, 1)
-	// Lock memory allotted to chunk from being used in SWAP
-	if err := syscall.Mlock(chunk); err != nil {
-		return err
+	defer of.Unlock()
+	of.destroyed = true
+	if of.readers > 0 {
+		return nil
+	}
+	return of.wipe()
+}
+
+// Destroyed reports whether Destroy has been called on the buffer.
+func (of *OnionBuffer) Destroyed() bool {
+	of.Lock()
+	defer of.Unlock()
+	return of.destroyed
+}
+
+// wipe zeroes and releases the buffer's bytes. The caller must hold the
+// buffer lock.
+func (of *OnionBuffer) wipe() error {
+	if of.Bytes == nil {
+		return nil
+	}
+	Wipe(of.Bytes)
+	// Free wiped allotted memory for SWAP usage
+	err := syscall.Munlock(of.Bytes)
+	of.Bytes = nil
+	of.Checksum = ""
+	return err
+}
+
+// BufferReader reads and seeks within an OnionBuffer's bytes. It must be
+// closed once done with so the buffer can be wiped.
+type BufferReader struct {
+	*bytes.Reader
+	of     *OnionBuffer
+	closed bool
+}
+
+// NewReader returns a reader over the buffer's bytes. A buffer is not
+// wiped until all of its readers are closed, so transfers in flight
+// aren't cut short when it is destroyed.
+func (of *OnionBuffer) NewReader() (*BufferReader, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.destroyed {
+		return nil, ErrDestroyed
 	}
-	bufFile, _ := zWriter.Create(of.Name)
-	for {
-		if _, err = reader.Read(chunk); err != nil {
-			break
+	of.readers++
+	return &BufferReader{Reader: bytes.NewReader(of.Bytes), of: of}, nil
+}
+
+// Close releases the reader, wiping the buffer if it was destroyed while
+// the reader was open.
+func (br *BufferReader) Close() error {
+	if br.closed {
+		return nil
+	}
+	br.closed = true
+	of := br.of
+	of.Lock()
+	defer of.Unlock()
+	of.readers--
+	if of.destroyed && of.readers == 0 {
+		return of.wipe()
+	}
+	return nil
+}
+
+// StartDownload reserves a download against the buffer's limit for a
+// transfer about to start. It returns false once the limit has been
+// reached or the remaining downloads are all in progress, so concurrent
+// requests can't exceed it. EndDownload must be called when it's done.
+func (of *OnionBuffer) StartDownload() bool {
+	of.Lock()
+	defer of.Unlock()
+	if of.DownloadLimit > 0 && of.Downloads+of.transfers >= of.DownloadLimit {
+		return false
+	}
+	of.transfers++
+	return true
+}
+
+// DeliverBytes grants up to n more bytes to a transfer of content that is
+// size bytes long. With a download limit the bytes granted over all
+// requests never add up to more than limit times size, however the
+// content is split into ranges.
+func (of *OnionBuffer) DeliverBytes(n, size int64) int64 {
+	of.Lock()
+	defer of.Unlock()
+	if of.DownloadLimit > 0 {
+		remaining := int64(of.DownloadLimit)*size - of.delivered
+		if remaining < 0 {
+			remaining = 0
 		}
-		_, err := bufFile.Write([]byte("0"))
-		if err != nil {
-			return err
+		if n > remaining {
+			n = remaining
 		}
 	}
-	if err != io.EOF {
-		return err
-	} else {
-		err = nil
+	of.delivered += n
+	return n
+}
+
+// ChargeBytes takes n bytes of content that is size bytes long from the
+// download allowance up front, so a transfer that must send all of them
+// can't be cut short by others. It reports false, taking nothing, if the
+// allowance left is smaller than n.
+func (of *OnionBuffer) ChargeBytes(n, size int64) bool {
+	of.Lock()
+	defer of.Unlock()
+	if of.DownloadLimit > 0 && int64(of.DownloadLimit)*size-of.delivered < n {
+		return false
 	}
-	if err := syscall.Munlock(of.Bytes); err != nil {
-		return err
+	of.delivered += n
+	return true
+}
+
+// RefundBytes gives back n bytes charged by ChargeBytes that were never
+// delivered.
+func (of *OnionBuffer) RefundBytes(n int64) {
+	of.Lock()
+	defer of.Unlock()
+	of.delivered -= n
+}
+
+// EndDownload releases a transfer reserved by StartDownload and counts a
+// download for every size bytes delivered, so a download resumed over
+// several partial requests is counted once. It reports whether the limit
+// has now been reached.
+func (of *OnionBuffer) EndDownload(size int64) bool {
+	of.Lock()
+	defer of.Unlock()
+	of.transfers--
+	if size > 0 {
+		of.Downloads = int(of.delivered / size)
 	}
-	of.Unlock()
-	return nil
+	return of.DownloadLimit > 0 && of.Downloads >= of.DownloadLimit
+}
+
+// LimitReached reports whether the buffer has been downloaded as many
+// times as its download limit allows.
+func (of *OnionBuffer) LimitReached() bool {
+	of.Lock()
+	defer of.Unlock()
+	return of.DownloadLimit > 0 && of.Downloads >= of.DownloadLimit
 }
 
+// SetDownloadLimit changes how many downloads the buffer allows, 0 means
+// no limit. Lowering it to the downloads already made ends the link.
+func (of *OnionBuffer) SetDownloadLimit(limit int) {
+	of.Lock()
+	defer of.Unlock()
+	of.DownloadLimit = limit
+}
+
+// StartAttempt reserves a password attempt against the buffer. Attempts
+// are made one at a time and, after a wrong password, not before an
+// exponentially growing backoff has passed. If no attempt can be made now
+// it returns false and how long to wait.
+func (of *OnionBuffer) StartAttempt() (bool, time.Duration) {
+	of.Lock()
+	defer of.Unlock()
+	if of.attempting {
+		return false, attemptBackoff
+	}
+	if wait := time.Until(of.nextAttempt); wait > 0 {
+		return false, wait
+	}
+	of.attempting = true
+	return true, 0
+}
+
+// EndAttempt finishes an attempt started with StartAttempt and returns the
+// number of consecutive wrong passwords so far.
+func (of *OnionBuffer) EndAttempt(wrongPassword bool) int {
+	of.Lock()
+	defer of.Unlock()
+	of.attempting = false
+	if !wrongPassword {
+		of.FailedAttempts = 0
+		return 0
+	}
+	of.FailedAttempts++
+	backoff := attemptBackoff
+	for i := 1; i < of.FailedAttempts && backoff < maxAttemptBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxAttemptBackoff {
+		backoff = maxAttemptBackoff
+	}
+	of.nextAttempt = time.Now().Add(backoff)
+	return of.FailedAttempts
+}
+
+// IsExpired reports whether the buffer's download link has expired.
+// A zero ExpiresAt means the buffer never expires.
 func (of *OnionBuffer) IsExpired() bool {
-	if of.ExpiresAt.After(time.Now()) {
+	of.Lock()
+	defer of.Unlock()
+	if of.ExpiresAt.IsZero() || of.ExpiresAt.After(time.Now()) {
 		return false
 	}
 	return true
@@ -0,0 +1,244 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func newTestBuffer() *OnionBuffer {
+	data := make([]byte, 64)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	return &OnionBuffer{Name: "test", Bytes: data}
+}
+
+func assertZero(t *testing.T, b []byte) {
+	t.Helper()
+	for i, c := range b {
+		if c != 0 {
+			t.Fatalf("byte %d is %#x after wipe, want 0", i, c)
+		}
+	}
+}
+
+func TestDestroyWipesSavedBytes(t *testing.T) {
+	of := newTestBuffer()
+	saved := of.Bytes
+	if err := of.Destroy(); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	if of.Bytes != nil {
+		t.Error("Bytes still set after Destroy")
+	}
+	assertZero(t, saved)
+}
+
+func TestDestroyWaitsForReaders(t *testing.T) {
+	of := newTestBuffer()
+	saved := of.Bytes
+	r, err := of.NewReader()
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if err := of.Destroy(); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	if _, err := of.NewReader(); err != ErrDestroyed {
+		t.Errorf("NewReader after Destroy returned %v, want ErrDestroyed", err)
+	}
+	// The open reader still sees every byte
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading destroyed buffer: %v", err)
+	}
+	for i, c := range got {
+		if c != byte(i+1) {
+			t.Fatalf("byte %d read as %#x before the reader closed, want %#x", i, c, byte(i+1))
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	assertZero(t, saved)
+	// Closing again must not count the reader twice
+	if err := r.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestWipeClearsCapacity(t *testing.T) {
+	b := make([]byte, 8, 32)
+	full := b[:cap(b)]
+	for i := range full {
+		full[i] = 0xff
+	}
+	Wipe(b)
+	assertZero(t, full)
+}
+
+// useCheapKDF keeps key derivation fast until the returned func is
+// called.
+func useCheapKDF() func() {
+	params := DefaultKDFParams
+	DefaultKDFParams = KDFParams{Time: 1, Memory: 64, Threads: 1}
+	return func() { DefaultKDFParams = params }
+}
+
+// testPlaintext returns n bytes that differ from chunk to chunk.
+func testPlaintext(n int) []byte {
+	plain := make([]byte, n)
+	for i := range plain {
+		plain[i] = byte(i % 251)
+	}
+	return plain
+}
+
+func encryptStream(t *testing.T, plain []byte, passphrase string) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	ew, err := NewEncryptWriter(&sealed, passphrase)
+	if err != nil {
+		t.Fatalf("NewEncryptWriter: %v", err)
+	}
+	if _, err := ew.Write(plain); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return sealed.Bytes()
+}
+
+// decryptStream reads data back through a DecryptReader.
+func decryptStream(data []byte, passphrase string) ([]byte, error) {
+	dr, err := NewDecryptReader(bytes.NewReader(data), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	return ioutil.ReadAll(dr)
+}
+
+// decryptSeekable reads data back through a DecryptSeeker.
+func decryptSeekable(data []byte, passphrase string) ([]byte, error) {
+	ds, err := NewDecryptSeeker(bytes.NewReader(data), int64(len(data)), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	return ioutil.ReadAll(ds)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	defer useCheapKDF()()
+	sizes := []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, DefaultChunkSize + 1, 2 * DefaultChunkSize}
+	for _, size := range sizes {
+		plain := testPlaintext(size)
+		sealed := encryptStream(t, plain, "secret")
+		got, err := decryptStream(sealed, "secret")
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes through DecryptReader: got %d bytes, %v", size, len(got), err)
+		}
+		got, err = decryptSeekable(sealed, "secret")
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes through DecryptSeeker: got %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	defer useCheapKDF()()
+	// Three full chunks and a short final one
+	plain := testPlaintext(3*DefaultChunkSize + 1)
+	sealed := encryptStream(t, plain, "secret")
+	// Every sealed chunk carries a 16 byte GCM tag
+	sealedChunk := DefaultChunkSize + 16
+	chunk := func(i int) []byte {
+		start := headerStreamSize + i*sealedChunk
+		return sealed[start : start+sealedChunk]
+	}
+	swapped := append([]byte(nil), sealed...)
+	copy(swapped[headerStreamSize+sealedChunk:], chunk(2))
+	copy(swapped[headerStreamSize+2*sealedChunk:], chunk(1))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"dropped final chunk", sealed[:headerStreamSize+3*sealedChunk]},
+		{"swapped chunks", swapped},
+	}
+	for _, tt := range tests {
+		if got, err := decryptStream(tt.data, "secret"); err == nil {
+			t.Errorf("%s: DecryptReader returned %d bytes without error", tt.name, len(got))
+		}
+		if got, err := decryptSeekable(tt.data, "secret"); err == nil {
+			t.Errorf("%s: DecryptSeeker returned %d bytes without error", tt.name, len(got))
+		}
+	}
+}
+
+func TestStreamWrongPassword(t *testing.T) {
+	defer useCheapKDF()()
+	sealed := encryptStream(t, testPlaintext(DefaultChunkSize+1), "secret")
+	if _, err := NewDecryptReader(bytes.NewReader(sealed), "guess"); err != ErrWrongPassword {
+		t.Errorf("NewDecryptReader returned %v, want ErrWrongPassword", err)
+	}
+	if _, err := NewDecryptSeeker(bytes.NewReader(sealed), int64(len(sealed)), "guess"); err != ErrWrongPassword {
+		t.Errorf("NewDecryptSeeker returned %v, want ErrWrongPassword", err)
+	}
+}
+
+func TestDecryptSeekerAcrossChunks(t *testing.T) {
+	defer useCheapKDF()()
+	plain := testPlaintext(2*DefaultChunkSize + 100)
+	sealed := encryptStream(t, plain, "secret")
+	ds, err := NewDecryptSeeker(bytes.NewReader(sealed), int64(len(sealed)), "secret")
+	if err != nil {
+		t.Fatalf("NewDecryptSeeker: %v", err)
+	}
+	defer ds.Close()
+	if ds.Size() != int64(len(plain)) {
+		t.Fatalf("Size is %d, want %d", ds.Size(), len(plain))
+	}
+	// Spanning the first boundary
+	got := make([]byte, 200)
+	if _, err := ds.ReadAt(got, DefaultChunkSize-100); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(got, plain[DefaultChunkSize-100:DefaultChunkSize+100]) {
+		t.Error("ReadAt across the first chunk boundary doesn't match the plaintext")
+	}
+	// Spanning the second boundary into the short final chunk
+	if _, err := ds.Seek(2*DefaultChunkSize-10, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	got, err = ioutil.ReadAll(ds)
+	if err != nil {
+		t.Fatalf("reading after Seek: %v", err)
+	}
+	if !bytes.Equal(got, plain[2*DefaultChunkSize-10:]) {
+		t.Error("reading across the last chunk boundary doesn't match the plaintext")
+	}
+	if pos, err := ds.Seek(-5, io.SeekEnd); err != nil || pos != int64(len(plain)-5) {
+		t.Fatalf("Seek from the end returned %d, %v", pos, err)
+	}
+	got = make([]byte, 5)
+	if _, err := io.ReadFull(ds, got); err != nil || !bytes.Equal(got, plain[len(plain)-5:]) {
+		t.Errorf("reading the last bytes returned %v, %v", got, err)
+	}
+}
+
+func TestDecryptNeedsHeader(t *testing.T) {
+	// What the unsalted whole-buffer format looked like: a nonce and a
+	// sealed buffer with no header in front
+	data := testPlaintext(64)
+	if _, err := Decrypt(data, "secret"); err != errHeader {
+		t.Errorf("Decrypt returned %v, want errHeader", err)
+	}
+	if _, err := NewDecryptSeeker(bytes.NewReader(data), int64(len(data)), "secret"); err != errHeader {
+		t.Errorf("NewDecryptSeeker returned %v, want errHeader", err)
+	}
+}
@@ -1,83 +1,355 @@
 package onion_buffer
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// ErrBufferExists is returned by Add when a buffer with the same name is
+// already in the store.
+var ErrBufferExists = errors.New("buffer already exists")
+
+// ErrStoreFull is returned by Add when storing a buffer would take the
+// store over its byte budget.
+var ErrStoreFull = errors.New("store is full")
+
+var _ Store = (*OnionStore)(nil)
+var _ Reaper = (*OnionStore)(nil)
+
+// OnionStore is the default in-memory Store. It holds every OnionBuffer
+// indexed by name and is safe for concurrent use.
 type OnionStore struct {
-	BufferFiles []*OnionBuffer
+	sync.RWMutex
+	BufferFiles map[string]*OnionBuffer
+	// MaxBytes caps the bytes held across all buffers, 0 means no limit
+	MaxBytes int64
+	// Eviction decides which buffers make room when MaxBytes is reached
+	Eviction EvictionPolicy
+	// OnRemove, if set, is called with every buffer deleted, reaped or
+	// evicted once it has been destroyed, without the store locked
+	OnRemove func(oBuffer *OnionBuffer)
+	bytes    int64
+	reserved int64
+	// Reaper state, see StartReaper
+	wake    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+	stopped bool
 }
 
 func (store *OnionStore) Add(oBuffer *OnionBuffer) error {
+	var evicted []*OnionBuffer
+	defer func() { store.removed(evicted) }()
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.BufferFiles[oBuffer.Name]; ok {
+		return ErrBufferExists
+	}
 	oBuffer.Lock()
-	store.BufferFiles = append(store.BufferFiles, oBuffer)
+	defer oBuffer.Unlock()
+	size := int64(len(oBuffer.Bytes))
+	var err error
+	if evicted, err = store.makeRoom(size); err != nil {
+		return err
+	}
 	if err := syscall.Mlock(oBuffer.Bytes); err != nil {
 		return err
 	}
-	oBuffer.Unlock()
+	store.BufferFiles[oBuffer.Name] = oBuffer
+	store.bytes += size
+	// Let the reaper know there may be a sooner expiration
+	if !oBuffer.ExpiresAt.IsZero() {
+		store.wakeReaper()
+	}
 	return nil
 }
 
 func (store *OnionStore) Get(bufName string) *OnionBuffer {
+	store.RLock()
+	defer store.RUnlock()
+	return store.BufferFiles[bufName]
+}
+
+// Delete removes the buffer from the store and destroys it. Deleting a
+// buffer that is not in the store is a no-op.
+func (store *OnionStore) Delete(of *OnionBuffer) error {
+	store.Lock()
+	f, ok := store.BufferFiles[of.Name]
+	if ok {
+		store.remove(f)
+	}
+	store.Unlock()
+	if !ok {
+		return nil
+	}
+	// The buffer is no longer reachable through the store, so it can be
+	// destroyed without holding up other requests.
+	err := f.Destroy()
+	store.removed([]*OnionBuffer{f})
+	return err
+}
+
+func (store *OnionStore) Exists(bufName string) bool {
+	store.RLock()
+	defer store.RUnlock()
+	_, ok := store.BufferFiles[bufName]
+	return ok
+}
+
+func (store *OnionStore) List() []*OnionBuffer {
+	store.RLock()
+	buffers := make([]*OnionBuffer, 0, len(store.BufferFiles))
 	for _, f := range store.BufferFiles {
-		if f.Name == bufName {
-			return f
+		buffers = append(buffers, f)
+	}
+	store.RUnlock()
+	sortByAge(buffers)
+	return buffers
+}
+
+func (store *OnionStore) Stats() Stats {
+	store.RLock()
+	defer store.RUnlock()
+	stats := Stats{
+		Buffers:  len(store.BufferFiles),
+		Bytes:    store.bytes,
+		Reserved: store.reserved,
+		MaxBytes: store.MaxBytes,
+	}
+	for _, f := range store.BufferFiles {
+		f.Lock()
+		stats.Downloads += f.Downloads
+		if f.Encrypted {
+			stats.Encrypted++
 		}
+		f.Unlock()
+	}
+	return stats
+}
+
+// Reserve sets aside size bytes of the store's budget for a buffer that is
+// still being put together, such as a resumable upload. It returns
+// ErrStoreFull if the bytes can't be found, even after evicting.
+func (store *OnionStore) Reserve(size int64) error {
+	var evicted []*OnionBuffer
+	defer func() { store.removed(evicted) }()
+	store.Lock()
+	defer store.Unlock()
+	var err error
+	if evicted, err = store.makeRoom(size); err != nil {
+		return err
 	}
+	store.reserved += size
 	return nil
 }
 
-func (store *OnionStore) Delete(of *OnionBuffer) error {
-	for i, f := range store.BufferFiles {
-		if f.Name == of.Name {
-			if err := f.Destroy(); err != nil {
-				return err
-			}
-			// Remove from store
-			f.Lock()
-			store.BufferFiles = append(store.BufferFiles[:i], store.BufferFiles[i+1:]...)
-			// Free niled allotted memory for SWAP usage
-			if err := syscall.Munlock(f.Bytes); err != nil {
-				return err
+// Release returns bytes set aside by Reserve to the store's budget.
+func (store *OnionStore) Release(size int64) {
+	store.Lock()
+	defer store.Unlock()
+	store.reserved -= size
+	if store.reserved < 0 {
+		store.reserved = 0
+	}
+}
+
+// DestroyAll destroys and removes every buffer in the store. Every buffer
+// is removed even if destroying one of them fails, the first error is
+// returned.
+func (store *OnionStore) DestroyAll() error {
+	store.Lock()
+	defer store.Unlock()
+	var firstErr error
+	for name, f := range store.BufferFiles {
+		if err := f.Destroy(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("destroying buffer %s: %v", name, err)
+		}
+	}
+	store.BufferFiles = make(map[string]*OnionBuffer)
+	store.bytes = 0
+	return firstErr
+}
+
+// SetExpiry changes when a buffer expires and reschedules the reaper.
+func (store *OnionStore) SetExpiry(oBuffer *OnionBuffer, expiresAt time.Time) {
+	store.Lock()
+	defer store.Unlock()
+	oBuffer.Lock()
+	oBuffer.ExpiresAt = expiresAt
+	oBuffer.Unlock()
+	store.wakeReaper()
+}
+
+// DeleteExpiredBuffers destroys and removes every expired buffer in the
+// store. It returns the expiration time of the next buffer due to expire,
+// or the zero time if no remaining buffer has an expiration set.
+func (store *OnionStore) DeleteExpiredBuffers() (time.Time, error) {
+	var expired []*OnionBuffer
+	defer func() { store.removed(expired) }()
+	store.Lock()
+	defer store.Unlock()
+	var next time.Time
+	var firstErr error
+	for name, f := range store.BufferFiles {
+		if !f.IsExpired() {
+			if !f.ExpiresAt.IsZero() && (next.IsZero() || f.ExpiresAt.Before(next)) {
+				next = f.ExpiresAt
 			}
-			f.Unlock()
+			continue
+		}
+		// The buffer leaves the store even if wiping it fails so that
+		// an expired link can never be served again.
+		store.remove(f)
+		if err := f.Destroy(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("destroying expired buffer %s: %v", name, err)
 		}
+		expired = append(expired, f)
 	}
-	return nil
+	return next, firstErr
 }
 
-func (store *OnionStore) Exists(bufName string) bool {
+// makeRoom checks that size more bytes fit in the store's budget, evicting
+// buffers according to the eviction policy if needed, and returns the
+// buffers it evicted. The caller must hold the store lock.
+func (store *OnionStore) makeRoom(size int64) ([]*OnionBuffer, error) {
+	if store.MaxBytes <= 0 || store.bytes+store.reserved+size <= store.MaxBytes {
+		return nil, nil
+	}
+	// Don't throw away other buffers for one that will never fit
+	if store.reserved+size > store.MaxBytes || store.Eviction == EvictNone {
+		return nil, ErrStoreFull
+	}
+	var evicted []*OnionBuffer
+	victims := make([]*OnionBuffer, 0, len(store.BufferFiles))
 	for _, f := range store.BufferFiles {
-		if f.Name == bufName {
-			return true
+		victims = append(victims, f)
+	}
+	store.Eviction.sort(victims)
+	for _, f := range victims {
+		if store.bytes+store.reserved+size <= store.MaxBytes {
+			break
 		}
+		store.remove(f)
+		// The buffer is gone from the store either way, a failed wipe
+		// shouldn't stop the upload from being accepted.
+		_ = f.Destroy()
+		evicted = append(evicted, f)
 	}
-	return false
+	return evicted, nil
 }
 
-func (store *OnionStore) DestroyAll() error {
-	for i, f := range store.BufferFiles {
-		if err := f.Destroy(); err != nil {
-			return err
+// removed passes buffers taken out of the store to OnRemove. The caller
+// must not hold the store lock.
+func (store *OnionStore) removed(buffers []*OnionBuffer) {
+	if store.OnRemove == nil {
+		return
+	}
+	for _, f := range buffers {
+		store.OnRemove(f)
+	}
+}
+
+// remove takes a buffer out of the store and its byte accounting without
+// destroying it. The caller must hold the store lock.
+func (store *OnionStore) remove(f *OnionBuffer) {
+	delete(store.BufferFiles, f.Name)
+	store.bytes -= int64(len(f.Bytes))
+}
+
+// StartReaper starts a goroutine that removes buffers from the store as
+// soon as they expire. Rather than polling, the reaper sleeps until the
+// nearest expiration and is woken early whenever a buffer is added.
+// Errors are passed to errFn, which may be nil. A panic while reaping is
+// recovered and reported so that expiry keeps being enforced.
+func (store *OnionStore) StartReaper(errFn func(error)) {
+	store.Lock()
+	defer store.Unlock()
+	if store.quit != nil {
+		return
+	}
+	store.wake = make(chan struct{}, 1)
+	store.quit = make(chan struct{})
+	store.done = make(chan struct{})
+	go store.reap(errFn)
+}
+
+// StopReaper stops the reaper started by StartReaper and waits for it
+// to exit. It is safe to call if the reaper was never started.
+func (store *OnionStore) StopReaper() {
+	store.Lock()
+	if store.quit == nil || store.stopped {
+		store.Unlock()
+		return
+	}
+	store.stopped = true
+	close(store.quit)
+	store.Unlock()
+	<-store.done
+}
+
+func (store *OnionStore) reap(errFn func(error)) {
+	defer close(store.done)
+	for {
+		next := store.sweep(errFn)
+		// Only arm a timer if something is due to expire
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			expired = timer.C
 		}
-		f.Lock()
-		store.BufferFiles = append(store.BufferFiles[:i], store.BufferFiles[i+1:]...)
-		if err := syscall.Munlock(f.Bytes); err != nil {
-			return err
+		select {
+		case <-store.quit:
+		case <-store.wake:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-store.quit:
+			return
+		default:
 		}
-		f.Unlock()
 	}
-	//runtime.GC()
-	return nil
 }
 
-func DeleteExpiredBuffers() {
-	// TODO: implement go routine that always checks each onion file
-	//  if its expired. If so, destroy it.
+// sweep runs a single reaper pass, recovering from any panic so the
+// reaper goroutine survives it.
+func (store *OnionStore) sweep(errFn func(error)) (next time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			if errFn != nil {
+				errFn(fmt.Errorf("reaper panic: %v", r))
+			}
+			// Retry shortly instead of sleeping forever
+			next = time.Now().Add(time.Second)
+		}
+	}()
+	next, err := store.DeleteExpiredBuffers()
+	if err != nil && errFn != nil {
+		errFn(err)
+	}
+	return next
+}
+
+// wakeReaper nudges the reaper to recompute its next wake up. The caller
+// must hold the store lock.
+func (store *OnionStore) wakeReaper() {
+	if store.wake == nil {
+		return
+	}
+	select {
+	case store.wake <- struct{}{}:
+	default:
+	}
 }
 
 func NewStore() *OnionStore {
 	return &OnionStore{
-		BufferFiles: make([]*OnionBuffer, 0),
+		BufferFiles: make(map[string]*OnionBuffer),
 	}
 }
@@ -0,0 +1,107 @@
+package onion_buffer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store is implemented by every OnionBuffer storage backend. Handlers only
+// ever talk to a Store so backends can be swapped, or faked in tests,
+// without touching them.
+type Store interface {
+	// Add puts a buffer in the store, returning ErrBufferExists if a
+	// buffer with the same name is already present.
+	Add(oBuffer *OnionBuffer) error
+	// Get returns the named buffer or nil if it isn't in the store.
+	Get(bufName string) *OnionBuffer
+	// Delete removes the buffer from the store and destroys it.
+	Delete(oBuffer *OnionBuffer) error
+	// List returns a snapshot of the buffers in the store, oldest first.
+	List() []*OnionBuffer
+	// Stats summarises the contents of the store.
+	Stats() Stats
+	// Reserve sets aside bytes of the store's budget for a buffer that is
+	// still being put together, returning ErrStoreFull if they don't fit.
+	Reserve(size int64) error
+	// Release returns bytes set aside by Reserve.
+	Release(size int64)
+	// DestroyAll destroys and removes every buffer in the store.
+	DestroyAll() error
+	// SetExpiry changes when a buffer in the store expires, the zero time
+	// meaning never.
+	SetExpiry(oBuffer *OnionBuffer, expiresAt time.Time)
+}
+
+// Reaper is implemented by stores that remove expired buffers in the
+// background.
+type Reaper interface {
+	StartReaper(errFn func(error))
+	StopReaper()
+}
+
+// Stats is a point in time summary of a Store.
+type Stats struct {
+	Buffers   int
+	Encrypted int
+	Bytes     int64
+	// Reserved is the part of the budget set aside by Reserve
+	Reserved int64
+	// MaxBytes is the store's byte budget, 0 means no limit
+	MaxBytes  int64
+	Downloads int
+}
+
+// StoreOptions configures a store created by OpenStore.
+type StoreOptions struct {
+	// MaxBytes caps the bytes held across all buffers, 0 means no limit
+	MaxBytes int64
+	// Eviction decides which buffers make room when MaxBytes is reached
+	Eviction EvictionPolicy
+	// OnRemove, if set, is called with every buffer deleted, reaped or
+	// evicted from the store once it has been destroyed
+	OnRemove func(oBuffer *OnionBuffer)
+}
+
+// backends maps the names accepted by OpenStore to their constructors.
+var backends = map[string]func(opts StoreOptions) Store{
+	"memory": func(opts StoreOptions) Store {
+		store := NewStore()
+		store.MaxBytes = opts.MaxBytes
+		store.Eviction = opts.Eviction
+		store.OnRemove = opts.OnRemove
+		return store
+	},
+}
+
+// OpenStore creates a store using the named backend.
+func OpenStore(backend string, opts StoreOptions) (Store, error) {
+	newStore, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown store backend %q, must be one of: %s",
+			backend, strings.Join(Backends(), ", "))
+	}
+	return newStore(opts), nil
+}
+
+// Backends returns the names of every available store backend.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortByAge orders buffers oldest first, breaking ties by name so the
+// order is stable.
+func sortByAge(buffers []*OnionBuffer) {
+	sort.Slice(buffers, func(i, j int) bool {
+		if buffers[i].CreatedAt.Equal(buffers[j].CreatedAt) {
+			return buffers[i].Name < buffers[j].Name
+		}
+		return buffers[i].CreatedAt.Before(buffers[j].CreatedAt)
+	})
+}
@@ -0,0 +1,437 @@
+package onion_buffer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Streams are sealed in fixed size chunks so neither side ever needs the
+// whole plaintext in memory. Every chunk is sealed with AES-GCM under a
+// nonce made of a random prefix, the chunk's counter and a flag marking
+// the final chunk:
+//
+//	prefix [7]byte | counter uint32 | final byte
+//
+// Reordered or dropped chunks fail to open, and a stream cut short is
+// detected because its last chunk won't carry the final flag.
+const (
+	// DefaultChunkSize is the number of plaintext bytes per chunk
+	DefaultChunkSize = 64 * 1024
+	maxChunkSize     = 16 * 1024 * 1024
+	noncePrefixSize  = 7
+)
+
+var (
+	// ErrWrongPassword is returned when encrypted data can't be opened
+	// with the given passphrase.
+	ErrWrongPassword = errors.New("wrong password")
+	errChunkAuth     = errors.New("encrypted chunk failed authentication")
+	errTruncated     = errors.New("encrypted stream is truncated")
+	errTooManySegs   = errors.New("encrypted stream is too long")
+	errClosed        = errors.New("encrypted stream is closed")
+)
+
+// streamCipher seals and opens the chunks of a single stream.
+type streamCipher struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	nonce   []byte
+	counter uint32
+}
+
+func newStreamCipher(h *header, key []byte) (*streamCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &streamCipher{
+		aead:   aead,
+		prefix: h.noncePrefix,
+		aad:    h.marshal(),
+		nonce:  make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+// next returns the nonce for the next chunk.
+func (sc *streamCipher) next(final bool) ([]byte, error) {
+	if sc.counter == math.MaxUint32 {
+		return nil, errTooManySegs
+	}
+	nonce := sc.nonceFor(sc.counter, final)
+	sc.counter++
+	return nonce, nil
+}
+
+// nonceFor returns the nonce of the chunk with the given counter.
+func (sc *streamCipher) nonceFor(counter uint32, final bool) []byte {
+	copy(sc.nonce, sc.prefix)
+	binary.BigEndian.PutUint32(sc.nonce[noncePrefixSize:], counter)
+	sc.nonce[len(sc.nonce)-1] = 0
+	if final {
+		sc.nonce[len(sc.nonce)-1] = 1
+	}
+	return sc.nonce
+}
+
+// EncryptWriter encrypts everything written to it as a segmented stream.
+// Close must be called to seal the final chunk.
+type EncryptWriter struct {
+	w      io.Writer
+	sc     *streamCipher
+	buf    []byte
+	sealed []byte
+	closed bool
+}
+
+// NewEncryptWriter writes a header to w and returns a writer that
+// encrypts under a key derived from the passphrase using Argon2id with a
+// random salt and DefaultKDFParams.
+func NewEncryptWriter(w io.Writer, passphrase string) (*EncryptWriter, error) {
+	h := &header{
+		version:     formatStream,
+		params:      DefaultKDFParams,
+		salt:        make([]byte, saltSize),
+		chunkSize:   DefaultChunkSize,
+		noncePrefix: make([]byte, noncePrefixSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, h.salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, h.noncePrefix); err != nil {
+		return nil, err
+	}
+	key := deriveKey(passphrase, h.salt, h.params)
+	defer Wipe(key)
+	sc, err := newStreamCipher(h, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sc.aad); err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{
+		w:      w,
+		sc:     sc,
+		buf:    make([]byte, 0, h.chunkSize),
+		sealed: make([]byte, 0, int(h.chunkSize)+sc.aead.Overhead()),
+	}, nil
+}
+
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, the last
+		// chunk has to wait for Close to be marked final.
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close seals the final chunk and wipes the writer's buffers. It does not
+// close the underlying writer.
+func (ew *EncryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	err := ew.seal(true)
+	ew.closed = true
+	Wipe(ew.buf)
+	return err
+}
+
+func (ew *EncryptWriter) seal(final bool) error {
+	nonce, err := ew.sc.next(final)
+	if err != nil {
+		return err
+	}
+	ew.sealed = ew.sc.aead.Seal(ew.sealed[:0], nonce, ew.buf, ew.sc.aad)
+	Wipe(ew.buf)
+	ew.buf = ew.buf[:0]
+	_, err = ew.w.Write(ew.sealed)
+	return err
+}
+
+// DecryptReader decrypts a stream written by EncryptWriter. Close wipes
+// its buffers.
+type DecryptReader struct {
+	r       io.Reader
+	sc      *streamCipher
+	chunk   []byte
+	plain   []byte
+	pending []byte
+	final   bool
+}
+
+// NewDecryptReader returns a reader of the plaintext of the encrypted
+// data in r. The first chunk is opened straight away, so a wrong
+// passphrase is reported here rather than by Read.
+func NewDecryptReader(r io.Reader, passphrase string) (*DecryptReader, error) {
+	prefix := make([]byte, headerStreamSize)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	h, err := parseHeader(prefix[:n])
+	if err != nil {
+		return nil, err
+	}
+	key := deriveKey(passphrase, h.salt, h.params)
+	defer Wipe(key)
+	sc, err := newStreamCipher(h, key)
+	if err != nil {
+		return nil, err
+	}
+	dr := &DecryptReader{
+		r:     r,
+		sc:    sc,
+		chunk: make([]byte, int(h.chunkSize)+sc.aead.Overhead()+1),
+		plain: make([]byte, 0, h.chunkSize),
+	}
+	if err := dr.open(); err != nil {
+		dr.Close()
+		// The key is only wrong if the very first chunk won't open
+		if err == errChunkAuth {
+			err = ErrWrongPassword
+		}
+		return nil, err
+	}
+	return dr, nil
+}
+
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	for len(dr.pending) == 0 {
+		if dr.final {
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.pending)
+	dr.pending = dr.pending[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. The chunk buffer holds one byte
+// more than a full chunk so the final chunk can be told apart from a full
+// one that is followed by more data.
+func (dr *DecryptReader) open() error {
+	full := len(dr.chunk) - 1
+	// Carry over the byte read ahead by the previous call
+	start := 0
+	if dr.sc.counter > 0 {
+		dr.chunk[0] = dr.chunk[full]
+		start = 1
+	}
+	n, err := io.ReadFull(dr.r, dr.chunk[start:])
+	n += start
+	final := false
+	switch err {
+	case nil:
+		n = full
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+	if final && n < dr.sc.aead.Overhead() {
+		return errTruncated
+	}
+	nonce, err := dr.sc.next(final)
+	if err != nil {
+		return err
+	}
+	Wipe(dr.plain)
+	dr.plain, err = dr.sc.aead.Open(dr.plain[:0], nonce, dr.chunk[:n], dr.sc.aad)
+	if err != nil {
+		return errChunkAuth
+	}
+	dr.pending = dr.plain
+	dr.final = final
+	return nil
+}
+
+// Close wipes any decrypted bytes held by the reader. It does not close
+// the underlying reader.
+func (dr *DecryptReader) Close() error {
+	Wipe(dr.plain)
+	dr.pending = nil
+	dr.final = true
+	return nil
+}
+
+// DecryptSeeker provides random access to the plaintext of encrypted
+// data, decrypting only the chunk holding the current offset. Close wipes
+// its buffers.
+type DecryptSeeker struct {
+	r         io.ReaderAt
+	sc        *streamCipher
+	dataStart int64
+	chunkSize int64
+	chunks    int64
+	size      int64
+	offset    int64
+	current   int64
+	cipher    []byte
+	plain     []byte
+}
+
+// NewDecryptSeeker returns a seekable reader of the plaintext of the size
+// bytes of encrypted data in r. The first chunk is opened straight away,
+// so a wrong passphrase is reported here rather than by Read.
+func NewDecryptSeeker(r io.ReaderAt, size int64, passphrase string) (*DecryptSeeker, error) {
+	prefix := make([]byte, headerStreamSize)
+	n, err := r.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	h, err := parseHeader(prefix[:n])
+	if err != nil {
+		return nil, err
+	}
+	key := deriveKey(passphrase, h.salt, h.params)
+	defer Wipe(key)
+	sc, err := newStreamCipher(h, key)
+	if err != nil {
+		return nil, err
+	}
+	ds := &DecryptSeeker{
+		r:         r,
+		sc:        sc,
+		dataStart: int64(headerStreamSize),
+		chunkSize: int64(h.chunkSize),
+		current:   -1,
+		cipher:    make([]byte, int(h.chunkSize)+sc.aead.Overhead()),
+		plain:     make([]byte, 0, h.chunkSize),
+	}
+	// Work out the plaintext size from the chunk layout, only the final
+	// chunk may be short
+	sealedSize := ds.chunkSize + int64(sc.aead.Overhead())
+	data := size - ds.dataStart
+	ds.chunks = data / sealedSize
+	last := data % sealedSize
+	switch {
+	case last >= int64(sc.aead.Overhead()):
+		ds.chunks++
+		ds.size = (ds.chunks-1)*ds.chunkSize + last - int64(sc.aead.Overhead())
+	case last == 0 && ds.chunks > 0:
+		ds.size = ds.chunks * ds.chunkSize
+	default:
+		return nil, errTruncated
+	}
+	if ds.chunks > math.MaxUint32 {
+		return nil, errTooManySegs
+	}
+	if err := ds.load(0); err != nil {
+		ds.Close()
+		// The key is only wrong if the very first chunk won't open
+		if err == errChunkAuth {
+			err = ErrWrongPassword
+		}
+		return nil, err
+	}
+	return ds, nil
+}
+
+// Size returns the size of the plaintext.
+func (ds *DecryptSeeker) Size() int64 {
+	return ds.size
+}
+
+func (ds *DecryptSeeker) Read(p []byte) (int, error) {
+	if ds.offset >= ds.size {
+		return 0, io.EOF
+	}
+	index := ds.offset / ds.chunkSize
+	if err := ds.load(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, ds.plain[ds.offset-index*ds.chunkSize:])
+	ds.offset += int64(n)
+	return n, nil
+}
+
+func (ds *DecryptSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ds.offset
+	case io.SeekEnd:
+		offset += ds.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	ds.offset = offset
+	return offset, nil
+}
+
+// ReadAt decrypts len(p) bytes starting at offset off. It moves the read
+// position, so it must not be used concurrently with Read or Seek.
+func (ds *DecryptSeeker) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := ds.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(ds, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// load decrypts the chunk with the given index unless it is already the
+// current one.
+func (ds *DecryptSeeker) load(index int64) error {
+	if index == ds.current {
+		return nil
+	}
+	sealedSize := ds.chunkSize + int64(ds.sc.aead.Overhead())
+	final := index == ds.chunks-1
+	sealed := ds.cipher
+	if final {
+		sealed = sealed[:ds.size-index*ds.chunkSize+int64(ds.sc.aead.Overhead())]
+	}
+	if _, err := ds.r.ReadAt(sealed, ds.dataStart+index*sealedSize); err != nil && err != io.EOF {
+		return err
+	}
+	Wipe(ds.plain)
+	ds.current = -1
+	plain, err := ds.sc.aead.Open(ds.plain[:0], ds.sc.nonceFor(uint32(index), final), sealed, ds.sc.aad)
+	if err != nil {
+		return errChunkAuth
+	}
+	ds.plain = plain
+	ds.current = index
+	return nil
+}
+
+// Close wipes any decrypted bytes held by the seeker. It does not close
+// the underlying reader.
+func (ds *DecryptSeeker) Close() error {
+	Wipe(ds.plain)
+	ds.current = -1
+	return nil
+}
@@ -0,0 +1,35 @@
+package onion_buffer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// tokenSize is the number of random bytes in a management token.
+const tokenSize = 32
+
+// NewToken creates a secret token that lets the uploader manage the
+// buffer and replaces any previous one. Only a hash of it is kept, so the token
+// can't be recovered from the store.
+func (of *OnionBuffer) NewToken() (string, error) {
+	b := make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	hash := sha256.Sum256([]byte(token))
+	of.Lock()
+	of.tokenHash = hash[:]
+	of.Unlock()
+	return token, nil
+}
+
+// ValidToken reports whether token is the buffer's management token.
+func (of *OnionBuffer) ValidToken(token string) bool {
+	hash := sha256.Sum256([]byte(token))
+	of.Lock()
+	defer of.Unlock()
+	return of.tokenHash != nil && subtle.ConstantTimeCompare(hash[:], of.tokenHash) == 1
+}
@@ -0,0 +1,11 @@
+package onion_buffer
+
+// Wipe overwrites every byte of b's backing array with zeros, including
+// any capacity beyond its length. Use it on sensitive copies, such as
+// decrypted buffers, once they are no longer needed.
+func Wipe(b []byte) {
+	b = b[:cap(b)]
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -2,142 +2,451 @@ package main
 
 import (
 	"archive/zip"
-	"bufio"
 	"bytes"
 	"context"
-	"crypto/md5"
+	"crypto"
+	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/Pallinder/go-randomdata"
-	"github.com/cretz/bine/tor"
-	"github.com/ipsn/go-libtor"
 	"onionbox/onion_buffer"
 	"onionbox/templates"
 )
 
 type onionbox struct {
-	debug       bool
-	logger      *log.Logger
-	store       *onion_buffer.OnionStore
-	maxMemory   int64
-	torVersion3 bool
-	onionURL    string
-	chunkSize   int
+	debug        bool
+	logger       *log.Logger
+	store        onion_buffer.Store
+	pending      *pendingUploads
+	storeType    string
+	maxStore     int64
+	eviction     string
+	maxMemory    int64
+	torVersion3  bool
+	baseURL      string
+	localAddr    string
+	keyFile      string
+	keyPass      bool
+	authDir      string
+	newClient    string
+	receive      bool
+	adminKey     string
+	share        *shareOptions
+	website      *websiteOptions
+	chat         bool
+	chats        *chatRooms
+	chunkSize    int
+	csrfKey      []byte
+	kdfTime      uint
+	kdfMemory    uint
+	kdfThreads   uint
+	maxAttempts  int
+	rateLimit    float64
+	rateBurst    int
+	drainTimeout time.Duration
+	// newCredentials are clients created on this run, whose keys are
+	// printed once the onion address is known
+	newCredentials []*clientCredential
+	// stop is closed to shut down without a signal
+	stop chan struct{}
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run starts onionbox and serves until it is told to stop, returning the
+// process exit code.
+func run() (code int) {
+	// The client subcommands run without a server
+	if len(os.Args) > 1 && (os.Args[1] == "get" || os.Args[1] == "put") {
+		return runClient(os.Args[1], os.Args[2:])
+	}
 	// Create onionbox instance that stores config
 	ob := onionbox{
-		logger: log.New(os.Stdout, "[onionbox] ", log.LstdFlags),
-		store:  onion_buffer.NewStore(),
-	}
-	// Init flags
-	flag.BoolVar(&ob.debug, "debug", false, "run in debug mode")
-	flag.BoolVar(&ob.torVersion3, "torv3", true, "use version 3 of the Tor circuit")
-	flag.Int64Var(&ob.maxMemory, "mem", 128, "max memory allotted for handling file buffers")
-	flag.IntVar(&ob.chunkSize, "chunk", 1024, "size of chunks for buffer I/O")
+		logger:  log.New(os.Stdout, "[onionbox] ", log.LstdFlags),
+		pending: newPendingUploads(),
+		chats:   newChatRooms(),
+	}
+	// Init flags, onionbox share takes the same flags and its own
+	fs := flag.CommandLine
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "share" {
+		ob.share = &shareOptions{}
+		fs = flag.NewFlagSet("share", flag.ExitOnError)
+		fs.Usage = subcommandUsage(fs, "share [flags] <paths...>")
+		ob.share.flags(fs)
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "website" {
+		ob.website = &websiteOptions{}
+		fs = flag.NewFlagSet("website", flag.ExitOnError)
+		fs.Usage = subcommandUsage(fs, "website [flags] <directory>")
+		ob.website.flags(fs)
+		args = args[1:]
+	}
+	fs.BoolVar(&ob.debug, "debug", false, "run in debug mode")
+	fs.BoolVar(&ob.torVersion3, "torv3", true, "use version 3 of the Tor circuit")
+	fs.StringVar(&ob.localAddr, "local", "", "serve without Tor on this TCP address or unix:/path socket, "+
+		"for development and testing")
+	fs.StringVar(&ob.keyFile, "keyfile", "", "file holding the onion service key, created if missing, "+
+		"to keep the same onion address across restarts")
+	fs.BoolVar(&ob.keyPass, "keypass", false, "protect the -keyfile with a passphrase, asked for on start or "+
+		"read from "+keyPassphraseEnv)
+	fs.StringVar(&ob.authDir, "authdir", "", "directory of authorized v3 clients' .auth files, only these "+
+		"clients can connect to the onion service")
+	fs.StringVar(&ob.newClient, "addclient", "", "create a client with this name in -authdir and print its "+
+		".auth_private line")
+	fs.BoolVar(&ob.receive, "receive", false, "receive-only drop box mode, uploads get no download link and are "+
+		"kept for the operator to collect from the admin page")
+	fs.BoolVar(&ob.chat, "chat", false, "give every share a chat room, kept in memory only, for the uploader and "+
+		"recipients")
+	fs.StringVar(&ob.baseURL, "baseurl", "", "base URL used in printed links, defaults to the onion or -local address")
+	fs.Int64Var(&ob.maxMemory, "mem", 128, "max memory in MB allotted for handling a single upload, larger uploads are refused")
+	fs.IntVar(&ob.chunkSize, "chunk", 1024, "size of chunks for buffer I/O")
+	fs.StringVar(&ob.storeType, "store", "memory", fmt.Sprintf("storage backend for file buffers (%s)",
+		strings.Join(onion_buffer.Backends(), ", ")))
+	fs.Int64Var(&ob.maxStore, "maxstore", 0, "max memory in MB held by all file buffers, 0 for no limit "+
+		"(keep this below RLIMIT_MEMLOCK so buffers can be mlocked)")
+	fs.StringVar(&ob.eviction, "evict", "none", "buffers to evict when -maxstore is reached (none, oldest, expiring)")
+	fs.UintVar(&ob.kdfTime, "kdftime", uint(onion_buffer.DefaultKDFParams.Time),
+		"Argon2id passes used to derive keys from passwords")
+	fs.UintVar(&ob.kdfMemory, "kdfmem", uint(onion_buffer.DefaultKDFParams.Memory>>10),
+		"Argon2id memory in MB used to derive keys from passwords")
+	fs.UintVar(&ob.kdfThreads, "kdfthreads", uint(onion_buffer.DefaultKDFParams.Threads),
+		"Argon2id parallelism used to derive keys from passwords")
+	fs.IntVar(&ob.maxAttempts, "maxattempts", 10,
+		"wrong passwords allowed before an encrypted share is destroyed, 0 for no limit")
+	fs.Float64Var(&ob.rateLimit, "ratelimit", 0, "requests per second served across all clients, 0 for no limit")
+	fs.IntVar(&ob.rateBurst, "rateburst", 20, "requests allowed in a burst above -ratelimit")
+	fs.DurationVar(&ob.drainTimeout, "drain", 30*time.Second,
+		"time allowed for transfers in flight to finish when shutting down")
 	// Parse flags
-	flag.Parse()
+	fs.Parse(args)
+	if ob.share != nil {
+		ob.share.paths = fs.Args()
+	}
+	if ob.website != nil {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		ob.website.root = fs.Arg(0)
+	}
 
-	// Start tor
-	ob.logf("Starting and registering onion service, please wait...")
-	t, err := tor.Start(nil, &tor.StartConf{
-		ProcessCreator: libtor.Creator,
-		DebugWriter:    os.Stderr,
+	// Set password key derivation cost
+	if ob.kdfTime < 1 || ob.kdfMemory < 1 || ob.kdfThreads < 1 || ob.kdfThreads > 255 {
+		fmt.Fprintf(os.Stderr, "Invalid key derivation parameters, -kdftime, -kdfmem and -kdfthreads must be at least 1\n")
+		return 1
+	}
+	onion_buffer.DefaultKDFParams = onion_buffer.KDFParams{
+		Time:    uint32(ob.kdfTime),
+		Memory:  uint32(ob.kdfMemory << 10),
+		Threads: uint8(ob.kdfThreads),
+	}
+
+	// Create the key signing CSRF tokens, tokens don't outlive the process
+	ob.csrfKey = make([]byte, 32)
+	if _, err := rand.Read(ob.csrfKey); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating CSRF key: %v\n", err)
+		return 1
+	}
+	// Create the buffer store
+	eviction, err := onion_buffer.ParseEvictionPolicy(ob.eviction)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing eviction policy: %v\n", err)
+		return 1
+	}
+	store, err := onion_buffer.OpenStore(ob.storeType, onion_buffer.StoreOptions{
+		MaxBytes: ob.maxStore << 20,
+		Eviction: eviction,
+		// Chat rooms go with their shares
+		OnRemove: func(oBuffer *onion_buffer.OnionBuffer) { ob.chats.remove(oBuffer.Name) },
 	})
 	if err != nil {
-		ob.logf("Failed to start Tor: %v", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Error creating store: %v\n", err)
+		return 1
+	}
+	ob.store = store
+	// Create the key the operator collects submissions with
+	if ob.receive {
+		if ob.adminKey, err = createAdminKey(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating admin key: %v\n", err)
+			return 1
+		}
+	}
+	// Serve the shared files in place of the upload form
+	if ob.share != nil {
+		if ob.receive {
+			fmt.Fprintf(os.Stderr, "onionbox share can't be used with -receive\n")
+			return 1
+		}
+		if err := ob.createShare(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating share: %v\n", err)
+			return 1
+		}
+		ob.stop = make(chan struct{})
+		go ob.watchShare()
+	}
+	// Publish a directory in place of the upload form
+	if ob.website != nil {
+		if ob.receive {
+			fmt.Fprintf(os.Stderr, "onionbox website can't be used with -receive\n")
+			return 1
+		}
+		// Evicting buffers would take pages off the site
+		if eviction != onion_buffer.EvictNone {
+			fmt.Fprintf(os.Stderr, "Error loading website: -evict can't be used with a website\n")
+			return 1
+		}
+		if err := ob.loadWebsite(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading website: %v\n", err)
+			return 1
+		}
 	}
+	// Remove buffers from the store as soon as they expire
+	if reaper, ok := ob.store.(onion_buffer.Reaper); ok {
+		reaper.StartReaper(func(err error) {
+			ob.logf("Error reaping expired buffers: %v", err)
+		})
+		defer reaper.StopReaper()
+	}
+	// Drop resumable uploads abandoned part way
+	ob.pending.startSweeper(&ob)
+	defer ob.pending.stopSweeper()
+
+	// Publish onionbox as an onion service unless serving locally
+	var pub publisher
+	if ob.localAddr != "" {
+		if ob.authDir != "" || ob.newClient != "" {
+			fmt.Fprintf(os.Stderr, "Client authorization needs Tor, it can't be used with -local\n")
+			return 1
+		}
+		pub = &localPublisher{address: ob.localAddr}
+	} else {
+		// Keep the same onion address across restarts if asked to
+		var key crypto.PrivateKey
+		if ob.keyFile != "" {
+			if !ob.torVersion3 {
+				fmt.Fprintf(os.Stderr, "A -keyfile can only be used with version 3 onion services\n")
+				return 1
+			}
+			if key, err = loadOnionKey(ob.keyFile, ob.keyPass); err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading onion key: %v\n", err)
+				return 1
+			}
+		}
+		// Only let authorized Tor clients connect if asked to
+		var clients map[string]string
+		if (ob.authDir != "" || ob.newClient != "") && !ob.torVersion3 {
+			fmt.Fprintf(os.Stderr, "Client authorization can only be used with version 3 onion services\n")
+			return 1
+		}
+		if ob.newClient != "" {
+			if ob.authDir == "" {
+				fmt.Fprintf(os.Stderr, "-addclient needs an -authdir to add the client to\n")
+				return 1
+			}
+			cred, err := createClient(ob.authDir, ob.newClient)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating client %s: %v\n", ob.newClient, err)
+				return 1
+			}
+			ob.newCredentials = append(ob.newCredentials, cred)
+		}
+		if ob.authDir != "" {
+			// Tor reads an authorized service's key from a file, which
+			// would undo -keypass unless it is kept in memory
+			if ob.keyPass && !serviceDirInMemory() {
+				fmt.Fprintf(os.Stderr, "-keypass can't be used with -authdir, %s isn't available to hand the key to Tor\n", serviceDirRoot)
+				return 1
+			}
+			if clients, err = loadAuthorizedClients(ob.authDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading authorized clients: %v\n", err)
+				return 1
+			}
+			if len(clients) == 0 {
+				fmt.Fprintf(os.Stderr, "No authorized clients in %s, add one with -addclient\n", ob.authDir)
+				return 1
+			}
+		}
+		ob.logf("Starting and registering onion service, please wait...")
+		if pub, err = newTorPublisher(ob.torVersion3, key, clients); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start Tor: %v\n", err)
+			return 1
+		}
+	}
+	return ob.serve(pub)
+}
+
+// subcommandUsage returns a FlagSet.Usage for an onionbox subcommand.
+func subcommandUsage(fs *flag.FlagSet, synopsis string) func() {
+	return func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", os.Args[0], synopsis)
+		fs.PrintDefaults()
+	}
+}
+
+// serve publishes onionbox through pub and serves until interrupted or
+// terminated, returning the process exit code.
+func (ob *onionbox) serve(pub publisher) (code int) {
+	// Tor is stopped last, once every buffer is wiped
 	defer func() {
-		if err := t.Close(); err != nil {
-			ob.logf("Error closing connection to Tor: %v", err)
-			os.Exit(1)
+		if err := pub.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing connection to Tor: %v\n", err)
+			code = 1
 		}
 	}()
 
 	// Wait at most a few minutes to publish the service
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer cancel()
-
-	// Create an onion service to listen on any port but show as 80
-	onionSvc, err := t.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}, Version3: ob.torVersion3})
+	ln, baseURL, err := pub.Listen(ctx)
 	if err != nil {
-		ob.logf("Failed to create onion service: %v", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Failed to create onion service: %v\n", err)
+		return 1
+	}
+	// Links are printed for the address the user gave, if any
+	if ob.baseURL == "" {
+		ob.baseURL = baseURL
+	}
+	ob.baseURL = strings.TrimSuffix(ob.baseURL, "/")
+	for _, cred := range ob.newCredentials {
+		serviceID := strings.TrimSuffix(strings.TrimPrefix(baseURL, "http://"), ".onion")
+		fmt.Printf("Add this line to the .auth_private file of client %s:\n%s\n", cred.name, cred.authPrivateLine(serviceID))
+	}
+	if ob.website != nil {
+		fmt.Printf("Your website is published at %s\n", ob.baseURL)
+	}
+	if ob.share != nil {
+		fmt.Printf("Share this link with your recipients: %s\n", ob.shareURL(ob.share.name))
+	}
+	if ob.receive {
+		fmt.Printf("Keep this link to yourself, it lists the files sent to you: %s\n", ob.adminURL())
+	}
+	if ob.localAddr != "" {
+		ob.logf("Serving without Tor, please navigate to %s\n", ob.baseURL)
+	} else {
+		ob.logf("Please open a Tor capable browser and navigate to %s\n", ob.baseURL)
 	}
-	defer func() {
-		if err := onionSvc.Close(); err != nil {
-			ob.logf("Error closing connection to onion service: %v", err)
-			os.Exit(1)
-		}
-	}()
-
-	ob.onionURL = onionSvc.ID
-	ob.logf("Please open a Tor capable browser and navigate to http://%v.onion\n", onionSvc.ID)
 
-	// Init routes
-	http.HandleFunc("/", ob.router)
 	// Init serving
 	srv := &http.Server{
 		IdleTimeout:  time.Second * 60,
 		ReadTimeout:  time.Second * 60,
 		WriteTimeout: time.Second * 60,
-		Handler:      nil,
+		Handler:      ob.routes(),
 	}
+	// Don't hold up shutdown for chat polls
+	srv.RegisterOnShutdown(ob.chats.stop)
 	// Begin serving
-	go ob.logger.Fatal(srv.Serve(onionSvc))
-	// Proper srv shutdown when program ends
-	defer func() {
-		if err := srv.Shutdown(context.Background()); err != nil {
-			ob.logf("Error shutting down onionbox srv: %v", err)
-			os.Exit(1)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+	// Serve until interrupted or terminated
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	select {
+	case sig := <-sigs:
+		ob.logf("Received %v, shutting down", sig)
+	case <-ob.stop:
+	case err := <-serveErr:
+		fmt.Fprintf(os.Stderr, "Error serving onionbox: %v\n", err)
+		code = 1
+	}
+	// Stop accepting requests and give transfers in flight a while to
+	// finish, a second signal cuts them off straight away
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), ob.drainTimeout)
+	defer drainCancel()
+	go func() {
+		select {
+		case <-sigs:
+			drainCancel()
+		case <-drainCtx.Done():
 		}
 	}()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error shutting down onionbox srv: %v\n", err)
+		if err := srv.Close(); err != nil {
+			ob.logf("Error closing onionbox srv: %v", err)
+		}
+		code = 1
+	}
+	// Wipe every buffer before the onion service and Tor go away
+	ob.destroy()
+	return code
 }
 
-func (ob *onionbox) router(w http.ResponseWriter, r *http.Request) {
-	// Set download url regex
-	downloadURLreg := regexp.MustCompile(`((?:[a-z][a-z]+))`)
-	if r.URL.Path == "/" {
-		ob.upload(w, r)
-	} else if matches := downloadURLreg.FindStringSubmatch(r.URL.Path); matches != nil {
-		if ob.store != nil {
-			if ob.store.Exists(r.URL.Path[1:]) {
-				r.Header.Set("filename", r.URL.Path[1:])
-				ob.download(w, r)
-			}
-		} else {
-			http.Error(w, "File not found", http.StatusNotFound)
-			return
-		}
-	} else {
-		http.Error(w, "404 page not found", http.StatusNotFound)
+// routes returns the handler serving every onionbox page and endpoint.
+func (ob *onionbox) routes() http.Handler {
+	m := newMux()
+	m.use(ob.logRequests, securityHeaders)
+	if ob.rateLimit > 0 {
+		m.use(newRateLimiter(ob.rateLimit, ob.rateBurst).rateLimit)
+	}
+	// A website is all that is served in website mode
+	if ob.website != nil {
+		m.handle("/{path...}", ob.serveWebsite, http.MethodGet, http.MethodHead)
+		return m
+	}
+	m.handle("/static/{file}", serveStatic, http.MethodGet, http.MethodHead)
+	if ob.share == nil {
+		m.handle("/", ob.upload, http.MethodGet, http.MethodPost)
+	}
+	// Nothing uploaded in receive mode can be fetched without the admin key
+	if ob.receive {
+		ob.receiveRoutes(m)
+		return m
 	}
+	m.handle("/d/{id}", ob.download, http.MethodGet, http.MethodHead, http.MethodPost)
+	m.handle("/d/{id}/manifest", ob.manifest, http.MethodGet, http.MethodHead)
+	// Only the shared files are served when sharing from the command line
+	if ob.share != nil {
+		ob.apiRoutes(m)
+		return m
+	}
+	m.handle("/manage/{id}", ob.manage, http.MethodGet, http.MethodPost)
+	if ob.chat {
+		m.handle("/d/{id}/chat", ob.chatPage, http.MethodGet, http.MethodPost)
+		m.handle("/d/{id}/chat/messages", ob.chatMessages, http.MethodGet)
+	}
+	m.handle(uploadsPath, ob.resumable, http.MethodPost, http.MethodOptions)
+	m.handle(uploadsPath+"/{id}", ob.resumable, http.MethodHead, http.MethodPatch, http.MethodDelete, http.MethodOptions)
+	ob.apiRoutes(m)
+	return m
 }
 
 func (ob *onionbox) upload(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		csrf, err := createCSRF()
+		csrf, err := ob.createCSRF(w, r)
 		if err != nil {
 			ob.logf("Error creating CSRF token: %v", err)
 			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
 			return
 		}
-		// Parse template
-		t, err := template.New("upload").Parse(templates.UploadHTML)
+		// Parse template, senders get a plain form in receive mode
+		page := templates.UploadHTML
+		if ob.receive {
+			page = templates.ReceiveHTML
+		}
+		t, err := template.New("upload").Parse(page)
 		if err != nil {
 			ob.logf("Error loading template: %v", err)
 			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
@@ -150,167 +459,319 @@ func (ob *onionbox) upload(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case http.MethodPost:
-		// Parse file(s) from form
-		if err := r.ParseMultipartForm(ob.maxMemory << 20); err != nil {
-			ob.logf("Error parsing files from form: %v", err)
-			http.Error(w, "Error parsing files.", http.StatusInternalServerError)
+		oBuffer, token := ob.receiveUpload(w, r, http.Error, true)
+		if oBuffer == nil {
+			return
+		}
+		if ob.receive {
+			ob.receivedSubmission(w, oBuffer)
 			return
 		}
-		// Create buffer for session in-memory zip file
-		zipBuffer := new(bytes.Buffer)
-		// Lock memory allotted to zipBuffer from being used in SWAP
-		if err := syscall.Mlock(zipBuffer.Bytes()); err != nil {
-			ob.logf("Error mlocking allotted memory for zipBuffer: %v", err)
-		}
-		zWriter := zip.NewWriter(zipBuffer)
-		files := r.MultipartForm.File["files"]
-		// Loop through all files in the form
-		for _, fileHeader := range files {
-			// Open uploaded file
-			file, err := fileHeader.Open()
+		// Write the zip's URL to client for sharing, and the management
+		// link only the uploader should keep
+		msg := fmt.Sprintf("Files uploaded. Please share this link with your recipients: %s\n\n"+
+			"Keep this link to yourself, it lets you see downloads, change the limits or destroy the files: %s",
+			ob.shareURL(oBuffer.Name), ob.manageURL(oBuffer.Name, token))
+		if ob.chat {
+			msg += fmt.Sprintf("\n\nRecipients can chat with you at %s, reply from the management page.",
+				ob.chatURL(oBuffer.Name))
+		}
+		_, err := w.Write([]byte(msg))
+		if err != nil {
+			ob.logf("Error writing to client: %v", err)
+			http.Error(w, "Error writing to client.", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+	}
+}
+
+// errorFunc responds to a failed request, http.Error for the HTML forms
+// and apiError for the API.
+type errorFunc func(w http.ResponseWriter, msg string, code int)
+
+// receiveUpload streams a multipart upload into a zip buffer and adds it
+// to the store, returning the buffer and its management token. Form
+// tokens are only checked if checkCSRF is set. On failure it responds
+// through fail and returns nil.
+func (ob *onionbox) receiveUpload(w http.ResponseWriter, r *http.Request, fail errorFunc, checkCSRF bool) (*onion_buffer.OnionBuffer, string) {
+	// Turn away uploads larger than -mem allows before reading them
+	if r.ContentLength > ob.maxMemory<<20 {
+		ob.uploadTooLarge(w, fail)
+		return nil, ""
+	}
+	// Set aside room in the store before reading any of the upload, one
+	// of unknown length gets as much as it is allowed to send
+	reserve := r.ContentLength
+	if reserve < 0 || reserve > ob.maxMemory<<20 {
+		reserve = ob.maxMemory << 20
+	}
+	if err := ob.store.Reserve(reserve); err == onion_buffer.ErrStoreFull {
+		ob.logf("Upload of %d bytes doesn't fit in the store", r.ContentLength)
+		fail(w, "Not enough space to store files.", http.StatusInsufficientStorage)
+		return nil, ""
+	} else if err != nil {
+		ob.logf("Error reserving store space: %v", err)
+		fail(w, "Error uploading files.", http.StatusInternalServerError)
+		return nil, ""
+	}
+	reserved := true
+	defer func() {
+		if reserved {
+			ob.store.Release(reserve)
+		}
+	}()
+	// Cap the upload at the memory allotted for file buffers
+	r.Body = http.MaxBytesReader(w, r.Body, ob.maxMemory<<20)
+	// Read the form as a stream rather than with ParseMultipartForm,
+	// which spills large files to disk
+	mr, err := r.MultipartReader()
+	if err != nil {
+		ob.logf("Error parsing files from form: %v", err)
+		fail(w, "Error parsing files.", http.StatusBadRequest)
+		return nil, ""
+	}
+	// Create buffer for session in-memory zip file
+	zipBuffer := new(bytes.Buffer)
+	// Lock memory allotted to zipBuffer from being used in SWAP
+	if err := syscall.Mlock(zipBuffer.Bytes()); err != nil {
+		ob.logf("Error mlocking allotted memory for zipBuffer: %v", err)
+	}
+	// Wipe the zip if the upload doesn't make it into the store
+	stored := false
+	defer func() {
+		if !stored {
+			onion_buffer.Wipe(zipBuffer.Bytes())
+		}
+	}()
+	chunk := make([]byte, ob.chunkSize)
+	// Lock memory allotted to chunk from being used in SWAP
+	if err := syscall.Mlock(chunk); err != nil {
+		ob.logf("Error mlocking allotted memory for chunk: %v", err)
+	}
+	defer onion_buffer.Wipe(chunk)
+	form := make(url.Values)
+	var zWriter *zip.Writer
+	var encWriter *onion_buffer.EncryptWriter
+	// Loop through all parts in the form, the upload form sends its
+	// options ahead of the files
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ob.logf("Error reading form: %v", err)
+			ob.uploadFailed(w, err, "Error uploading files.", fail)
+			return nil, ""
+		}
+		if part.FormName() != "files" {
+			value, err := readFormValue(part)
 			if err != nil {
-				ob.logf("Error opening file %s: %v", fileHeader.Filename, err)
-				http.Error(w, "Error uploading files.", http.StatusInternalServerError)
-				return
+				ob.logf("Error reading form value %s: %v", part.FormName(), err)
+				ob.uploadFailed(w, err, "Error uploading files.", fail)
+				return nil, ""
 			}
-			// Create file in zip with same name
-			bufFile, err := zWriter.Create(fileHeader.Filename)
-			if err != nil {
-				ob.logf("Error creating new file in zip: %v", err)
-				http.Error(w, "Error uploading files.", http.StatusInternalServerError)
-				return
+			// Senders can't protect, limit or expire submissions
+			if ob.receive && part.FormName() != "token" {
+				continue
 			}
-			// Read uploaded file
-			var count int
-			reader := bufio.NewReader(file)
-			chunk := make([]byte, ob.chunkSize)
-			// Lock memory allotted to chunk from being used in SWAP
-			if err := syscall.Mlock(chunk); err != nil {
-				ob.logf("Error mlocking allotted memory for chunk: %v", err)
+			form.Add(part.FormName(), value)
+			continue
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		// Set up the zip on the first file
+		if zWriter == nil {
+			// The token is sent ahead of the files
+			if checkCSRF && !ob.validCSRF(r, form.Get("token")) {
+				ob.forbidCSRF(w)
+				return nil, ""
 			}
-			for {
-				if count, err = reader.Read(chunk); err != nil {
-					break
-				}
-				_, err := bufFile.Write(chunk[:count])
+			var zipOut io.Writer = zipBuffer
+			// If password option was enabled, encrypt the zip as it is
+			// written so the unencrypted archive is never held in memory
+			if form.Get("password_enabled") == "on" {
+				encWriter, err = onion_buffer.NewEncryptWriter(zipBuffer, form.Get("password"))
 				if err != nil {
-					ob.logf("Error writing file to zip: %v", err)
-					http.Error(w, "Error writing file to zip", http.StatusInternalServerError)
-					return
+					ob.logf("Error encrypting buffer: %v", err)
+					fail(w, "Error encrypting buffer.", http.StatusInternalServerError)
+					return nil, ""
 				}
+				defer encWriter.Close()
+				zipOut = encWriter
 			}
-			if err != io.EOF {
-				ob.logf("Error reading uploaded file: %v", err)
-				http.Error(w, "Error reading uploaded file.", http.StatusInternalServerError)
-				return
-			} else {
-				err = nil
-			}
-			// Flush zipwriter to write compressed bytes to buffer
-			if err := zWriter.Flush(); err != nil {
-				ob.logf("Error flushing zip writer: %v", err)
-			}
+			zWriter = zip.NewWriter(zipOut)
 		}
-		// Close zipwriter
-		if err := zWriter.Close(); err != nil {
-			ob.logf("Error closing zip writer: %v", err)
-		}
-		// Create random zip name
-		zipBufferName := strings.ToLower(randomdata.SillyName())
-		// Create OnionBuffer object
-		oBuffer := &onion_buffer.OnionBuffer{Name: zipBufferName, CreatedAt: time.Now()}
-		// If password option was enabled
-		if r.FormValue("password_enabled") == "on" {
-			var err error
-			pass := r.FormValue("password")
-			oBuffer.Bytes, err = onion_buffer.Encrypt(zipBuffer.Bytes(), pass)
-			if err != nil {
-				ob.logf("Error encrypting buffer: %v", err)
-				http.Error(w, "Error encrypting buffer.", http.StatusInternalServerError)
-				return
-			}
-			// Lock memory allotted to oBuffer from being used in SWAP
-			if err := syscall.Mlock(oBuffer.Bytes); err != nil {
-				ob.logf("Error mlocking allotted memory for oBuffer: %v", err)
-			}
-			oBuffer.Encrypted = true
-			chksm, err := oBuffer.GetChecksum()
-			if err != nil {
-				ob.logf("Error getting checksum: %v", err)
-				http.Error(w, "Error getting checksum.", http.StatusInternalServerError)
-				return
-			}
-			oBuffer.Checksum = chksm
-		} else {
-			oBuffer.Bytes = zipBuffer.Bytes()
-			// Lock memory allotted to oBuffer from being used in SWAP
-			if err := syscall.Mlock(oBuffer.Bytes); err != nil {
-				ob.logf("Error mlocking allotted memory for oBuffer: %v", err)
-			}
-			// Get checksum
-			chksm, err := oBuffer.GetChecksum()
-			if err != nil {
-				ob.logf("Error getting checksum: %v", err)
-				http.Error(w, "Error getting checksum.", http.StatusInternalServerError)
-				return
-			}
-			oBuffer.Checksum = chksm
+		// Create file in zip with same name
+		bufFile, err := zWriter.Create(part.FileName())
+		if err != nil {
+			ob.logf("Error creating new file in zip: %v", err)
+			fail(w, "Error uploading files.", http.StatusInternalServerError)
+			return nil, ""
 		}
-		// If limit downloads was enabled
-		if r.FormValue("limit_downloads") == "on" {
-			form := r.FormValue("download_limit")
-			limit, err := strconv.Atoi(form)
-			if err != nil {
-				ob.logf("Error converting duration string into time.Duration: %v", err)
-				http.Error(w, "Error getting expiration time.", http.StatusInternalServerError)
-				return
-			}
-			oBuffer.DownloadLimit = limit
+		// Stream uploaded file into the zip
+		if _, err := io.CopyBuffer(bufFile, part, chunk); err != nil {
+			ob.logf("Error reading uploaded file: %v", err)
+			ob.uploadFailed(w, err, "Error reading uploaded file.", fail)
+			return nil, ""
 		}
-		// if expiration was enabled
-		if r.FormValue("expire") == "on" {
-			expiration := fmt.Sprintf("%sm", r.FormValue("expiration_time"))
-			t, err := time.ParseDuration(expiration)
-			if err != nil {
-				ob.logf("Error parsing expiration time: %v", err)
-				http.Error(w, "Error parsing expiration time.", http.StatusInternalServerError)
-				return
+		// Flush zipwriter to write compressed bytes to buffer
+		if err := zWriter.Flush(); err != nil {
+			ob.logf("Error flushing zip writer: %v", err)
+		}
+	}
+	if zWriter == nil {
+		if checkCSRF && !ob.validCSRF(r, form.Get("token")) {
+			ob.forbidCSRF(w)
+			return nil, ""
+		}
+		fail(w, "No files uploaded.", http.StatusBadRequest)
+		return nil, ""
+	}
+	// The password has to be known before the first file is zipped
+	if form.Get("password_enabled") == "on" && encWriter == nil {
+		fail(w, "Password options must be sent before files.", http.StatusBadRequest)
+		return nil, ""
+	}
+	// Close zipwriter
+	if err := zWriter.Close(); err != nil {
+		ob.logf("Error closing zip writer: %v", err)
+	}
+	// Seal the final encrypted chunk
+	if encWriter != nil {
+		if err := encWriter.Close(); err != nil {
+			ob.logf("Error encrypting buffer: %v", err)
+			fail(w, "Error encrypting buffer.", http.StatusInternalServerError)
+			return nil, ""
+		}
+	}
+	// The finished zip takes the place of the reservation in the budget
+	ob.store.Release(reserve)
+	reserved = false
+	oBuffer, token := ob.storeBuffer(w, zipBuffer.Bytes(), encWriter != nil, form, fail)
+	if oBuffer != nil {
+		stored = true
+	}
+	return oBuffer, token
+}
+
+// uploadFailed responds to an error reading an upload with msg, unless
+// the upload ran past -mem.
+func (ob *onionbox) uploadFailed(w http.ResponseWriter, err error, msg string, fail errorFunc) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		ob.uploadTooLarge(w, fail)
+		return
+	}
+	fail(w, msg, http.StatusBadRequest)
+}
+
+func (ob *onionbox) uploadTooLarge(w http.ResponseWriter, fail errorFunc) {
+	fail(w, fmt.Sprintf("Upload too large, at most %d MB can be sent at once.", ob.maxMemory), http.StatusRequestEntityTooLarge)
+}
+
+// storeBuffer wraps a finished zip in an OnionBuffer, applies the upload
+// options in form and adds it to the store, returning the buffer and its
+// management token. On failure it responds through fail, wipes data and
+// returns nil.
+func (ob *onionbox) storeBuffer(w http.ResponseWriter, data []byte, encrypted bool, form url.Values, fail errorFunc) (*onion_buffer.OnionBuffer, string) {
+	// Create OnionBuffer object, it is named once it makes it into the store
+	oBuffer := &onion_buffer.OnionBuffer{CreatedAt: time.Now()}
+	// Wipe the buffer if it doesn't make it into the store
+	stored := false
+	defer func() {
+		if !stored {
+			if err := oBuffer.Destroy(); err != nil {
+				ob.logf("Error destroying buffer %s: %v", oBuffer.Name, err)
 			}
-			oBuffer.ExpiresAt = oBuffer.CreatedAt.Add(t)
 		}
-		// Append onion file to filestore
-		if err := ob.store.Add(oBuffer); err != nil {
-			ob.logf("Error adding file to store: %v", err)
-			http.Error(w, "Error adding file to store.", http.StatusInternalServerError)
-			return
+	}()
+	oBuffer.Bytes = data
+	oBuffer.Encrypted = encrypted
+	// Lock memory allotted to oBuffer from being used in SWAP
+	if err := syscall.Mlock(oBuffer.Bytes); err != nil {
+		ob.logf("Error mlocking allotted memory for oBuffer: %v", err)
+	}
+	// Get checksum
+	chksm, err := oBuffer.GetChecksum()
+	if err != nil {
+		ob.logf("Error getting checksum: %v", err)
+		fail(w, "Error getting checksum.", http.StatusInternalServerError)
+		return nil, ""
+	}
+	oBuffer.Checksum = chksm
+	// If limit downloads was enabled
+	if form.Get("limit_downloads") == "on" {
+		limit, err := strconv.Atoi(form.Get("download_limit"))
+		if err != nil {
+			fail(w, "Invalid download limit.", http.StatusBadRequest)
+			return nil, ""
 		}
-		// Set temp oBuffer var to nil
-		if err := oBuffer.Destroy(); err != nil {
-			ob.logf("Error destroying temporary var for %s", oBuffer.Name)
+		if limit < 0 {
+			fail(w, "Download limit and expiration time can't be negative.", http.StatusBadRequest)
+			return nil, ""
 		}
-		// Write the zip's URL to client for sharing
-		_, err := w.Write([]byte(fmt.Sprintf("Files uploaded. Please share this link with your recipients: http://%s.onion/%s",
-			ob.onionURL, oBuffer.Name)))
+		oBuffer.DownloadLimit = limit
+	}
+	// if expiration was enabled
+	if form.Get("expire") == "on" {
+		minutes, err := strconv.Atoi(form.Get("expiration_time"))
 		if err != nil {
-			ob.logf("Error writing to client: %v", err)
-			http.Error(w, "Error writing to client.", http.StatusInternalServerError)
-			return
+			fail(w, "Invalid expiration time.", http.StatusBadRequest)
+			return nil, ""
 		}
-	default:
-		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		if minutes < 0 {
+			fail(w, "Download limit and expiration time can't be negative.", http.StatusBadRequest)
+			return nil, ""
+		}
+		oBuffer.ExpiresAt = oBuffer.CreatedAt.Add(time.Duration(minutes) * time.Minute)
 	}
+	// Only a hash of the management token is kept with the buffer
+	token, err := oBuffer.NewToken()
+	if err != nil {
+		ob.logf("Error creating management token: %v", err)
+		fail(w, "Error creating management token.", http.StatusInternalServerError)
+		return nil, ""
+	}
+	// Append onion file to filestore under a random name, trying another
+	// in the unlikely case it is taken
+	for i := 0; i < shareIDAttempts; i++ {
+		if oBuffer.Name, err = createShareID(); err != nil {
+			break
+		}
+		if err = ob.store.Add(oBuffer); err != onion_buffer.ErrBufferExists {
+			break
+		}
+	}
+	if err == onion_buffer.ErrStoreFull {
+		ob.logf("Error adding file to store: %v", err)
+		fail(w, "Not enough space to store files.", http.StatusInsufficientStorage)
+		return nil, ""
+	} else if err != nil {
+		ob.logf("Error adding file to store: %v", err)
+		fail(w, "Error adding file to store.", http.StatusInternalServerError)
+		return nil, ""
+	}
+	stored = true
+	return oBuffer, token
+}
+
+// shareURL returns the link recipients use to download a buffer.
+func (ob *onionbox) shareURL(name string) string {
+	return fmt.Sprintf("%s/d/%s", ob.baseURL, name)
 }
 
 func (ob *onionbox) download(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case http.MethodGet:
-		oBuffer := ob.store.Get(r.Header.Get("filename"))
+	case http.MethodGet, http.MethodHead:
+		oBuffer := ob.lookup(w, r, http.Error)
 		if oBuffer == nil {
-			http.Error(w, "Nil file", http.StatusInternalServerError)
 			return
 		}
 		if oBuffer.Encrypted {
-			csrf, err := createCSRF()
+			csrf, err := ob.createCSRF(w, r)
 			if err != nil {
 				ob.logf("Error creating CSRF token: %v", err)
 				http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
@@ -330,118 +791,225 @@ func (ob *onionbox) download(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		} else {
-			if oBuffer.DownloadLimit > 0 && oBuffer.Downloads >= oBuffer.DownloadLimit {
-				if err := ob.store.Delete(oBuffer); err != nil {
-					ob.logf("Error deleting onion file from store: %v", err)
-				}
-				ob.logf("Download limit reached for %s", oBuffer.Name)
-				http.Error(w, "Download limit reached.", http.StatusUnauthorized)
+			content, done := ob.openContent(w, oBuffer, "", http.Error)
+			if content == nil {
 				return
 			}
-			// Check expiration
-			//if oBuffer.IsExpired() {
-			//	if err := oBuffer.Destroy(); err != nil {
-			//		ob.logf("Error destroying buffer %s: %v", oBuffer.Name, err)
-			//	}
-			//	http.Error(w, "Download link has expired", http.StatusUnauthorized)
-			//	return
-			//}
-			// Validate checksum
-			chksmValid, err := oBuffer.ValidateChecksum()
-			if err != nil {
-				ob.logf("Error validating checksum: %v", err)
-				http.Error(w, "Error validating checksum.", http.StatusInternalServerError)
-				return
-			}
-			if !chksmValid {
-				ob.logf("Invalid checksum for file %s", oBuffer.Name)
-				http.Error(w, "Invalid checksum.", http.StatusInternalServerError)
-				return
-			}
-			// Increment files download count
-			oBuffer.Downloads++
-			// Set headers for browser to initiate download
-			w.Header().Set("Content-Type", "application/zip")
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", oBuffer.Name))
+			defer done()
 			// Write the zip bytes to the response for download
-			_, err = w.Write(oBuffer.Bytes)
-			if err != nil {
-				ob.logf("Error writing to client: %v", err)
-				http.Error(w, "Error writing to client.", http.StatusInternalServerError)
-				return
-			}
+			ob.serveBuffer(w, r, oBuffer, content, http.Error)
 		}
 	// If buffer was password protected
 	case http.MethodPost:
-		of := ob.store.Get(r.Header.Get("filename"))
-		if of == nil {
-			http.Error(w, "Nil file", http.StatusInternalServerError)
-			return
-		}
-		if of.DownloadLimit > 0 && of.Downloads >= of.DownloadLimit {
-			if err := ob.store.Delete(of); err != nil {
-				ob.logf("Error deleting onion file from store: %v", err)
-			}
-			ob.logf("Download limit reached for %s", of.Name)
-			http.Error(w, "Download limit reached.", http.StatusUnauthorized)
+		of := ob.lookup(w, r, http.Error)
+		if of == nil || !ob.parseSmallForm(w, r) {
 			return
 		}
-		// Check expiration
-		//if of.IsExpired() {
-		//	if err := of.Destroy(); err != nil {
-		//		ob.logf("Error destroying buffer %s: %v", of.Name, err)
-		//	}
-		//	http.Error(w, "Download link has expired", http.StatusUnauthorized)
-		//	return
-		//}
-		// Validate checksum
-		chksmValid, err := of.ValidateChecksum()
-		if err != nil {
-			ob.logf("Error validating checksum: %v", err)
-			http.Error(w, "Error validating checksum.", http.StatusInternalServerError)
+		if !ob.validCSRF(r, r.FormValue("token")) {
+			ob.forbidCSRF(w)
 			return
 		}
-		if !chksmValid {
-			ob.logf("Invalid checksum for file %s", of.Name)
-			http.Error(w, "Invalid checksum.", http.StatusInternalServerError)
+		// Get password and decrypt zip as it is streamed to the client
+		content, done := ob.openContent(w, of, r.FormValue("password"), http.Error)
+		if content == nil {
 			return
 		}
-		// Get password and decrypt zip for download
-		pass := r.FormValue("password")
-		decryptedBytes, err := onion_buffer.Decrypt(of.Bytes, pass)
+		defer done()
+		// Write the decrypted zip bytes to the response for download
+		ob.serveBuffer(w, r, of, content, http.Error)
+	default:
+		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+	}
+}
+
+// manifest lists the files in a buffer's zip as JSON without counting a
+// download. Encrypted buffers need the password in the Onionbox-Password
+// header.
+func (ob *onionbox) manifest(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.lookup(w, r, ob.apiError)
+	if oBuffer == nil {
+		return
+	}
+	content, done := ob.openContent(w, oBuffer, r.Header.Get(passwordHeader), ob.apiError)
+	if content == nil {
+		return
+	}
+	defer done()
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		ob.logf("Error reading zip: %v", err)
+		ob.apiError(w, "Error reading zip.", http.StatusInternalServerError)
+		return
+	}
+	zr, err := zip.NewReader(content.(io.ReaderAt), size)
+	if err != nil {
+		ob.logf("Error reading zip: %v", err)
+		ob.apiError(w, "Error reading zip.", http.StatusInternalServerError)
+		return
+	}
+	type manifestFile struct {
+		Name     string    `json:"name"`
+		Size     uint64    `json:"size"`
+		Modified time.Time `json:"modified"`
+	}
+	files := make([]manifestFile, 0, len(zr.File))
+	for _, f := range zr.File {
+		files = append(files, manifestFile{Name: f.Name, Size: f.UncompressedSize64, Modified: f.Modified})
+	}
+	ob.writeJSON(w, http.StatusOK, struct {
+		Name  string         `json:"name"`
+		Files []manifestFile `json:"files"`
+	}{oBuffer.Name, files})
+}
+
+// openContent checks a buffer can still be downloaded and returns a reader
+// over its zip, decrypted with pass if the buffer is encrypted. Only the
+// chunks covering the requested range are decrypted. done must be called
+// once the content has been served. On failure it responds through fail
+// and returns a nil reader.
+func (ob *onionbox) openContent(w http.ResponseWriter, oBuffer *onion_buffer.OnionBuffer, pass string, fail errorFunc) (io.ReadSeeker, func()) {
+	if oBuffer.LimitReached() {
+		ob.limitReached(w, oBuffer, fail)
+		return nil, nil
+	}
+	// Validate checksum
+	chksmValid, err := oBuffer.ValidateChecksum()
+	if err != nil {
+		ob.logf("Error validating checksum: %v", err)
+		fail(w, "Error validating checksum.", http.StatusInternalServerError)
+		return nil, nil
+	}
+	if !chksmValid {
+		ob.logf("Invalid checksum for file %s", oBuffer.Name)
+		fail(w, "Invalid checksum.", http.StatusInternalServerError)
+		return nil, nil
+	}
+	if !oBuffer.Encrypted {
+		reader, err := oBuffer.NewReader()
 		if err != nil {
-			ob.logf("Error decrypting buffer: %v", err)
-			http.Error(w, "Error decrypting buffer.", http.StatusInternalServerError)
-			return
+			fail(w, "File not found", http.StatusNotFound)
+			return nil, nil
 		}
-		// Lock memory allotted to decryptedBytes from being used in SWAP
-		if err := syscall.Mlock(decryptedBytes); err != nil {
-			ob.logf("Error mlocking allotted memory for decryptedBytes: %v", err)
-		}
-		// Increment files download count
-		of.Downloads++
-		// Set headers for browser to initiate download
-		w.Header().Set("Content-Type", "application/zip")
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", of.Name))
-		// Write the zip bytes to the response for download
-		_, err = w.Write(decryptedBytes)
-		if err != nil {
-			ob.logf("Error writing to client: %v", err)
-			http.Error(w, "Error writing to client.", http.StatusInternalServerError)
-			return
+		return reader, func() { reader.Close() }
+	}
+	// Only one password attempt at a time, backing off after failures
+	if ok, wait := oBuffer.StartAttempt(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		fail(w, "Too many password attempts, please wait before trying again.", http.StatusTooManyRequests)
+		return nil, nil
+	}
+	reader, err := oBuffer.NewReader()
+	if err != nil {
+		oBuffer.EndAttempt(false)
+		fail(w, "File not found", http.StatusNotFound)
+		return nil, nil
+	}
+	decrypter, err := onion_buffer.NewDecryptSeeker(reader, reader.Size(), pass)
+	if err == onion_buffer.ErrWrongPassword {
+		reader.Close()
+		ob.wrongPassword(w, oBuffer, fail)
+		return nil, nil
+	}
+	oBuffer.EndAttempt(false)
+	if err != nil {
+		reader.Close()
+		ob.logf("Error decrypting buffer: %v", err)
+		fail(w, "Error decrypting buffer.", http.StatusInternalServerError)
+		return nil, nil
+	}
+	// Wipe decrypted bytes once the request is done with them
+	return decrypter, func() {
+		decrypter.Close()
+		reader.Close()
+	}
+}
+
+// lookup returns the buffer named in the request path. If there is none,
+// or it has expired, it responds through fail and returns nil.
+func (ob *onionbox) lookup(w http.ResponseWriter, r *http.Request, fail errorFunc) *onion_buffer.OnionBuffer {
+	oBuffer := ob.store.Get(param(r, "id"))
+	if oBuffer == nil {
+		fail(w, "File not found", http.StatusNotFound)
+		return nil
+	}
+	// Check expiration, the reaper may not have run yet
+	if oBuffer.IsExpired() {
+		ob.expire(w, oBuffer, fail)
+		return nil
+	}
+	return oBuffer
+}
+
+// expire removes an expired buffer from the store and tells the client
+// the link is gone for good.
+func (ob *onionbox) expire(w http.ResponseWriter, oBuffer *onion_buffer.OnionBuffer, fail errorFunc) {
+	if err := ob.store.Delete(oBuffer); err != nil {
+		ob.logf("Error deleting expired buffer %s: %v", oBuffer.Name, err)
+	}
+	ob.logf("Download link expired for %s", oBuffer.Name)
+	fail(w, "Download link has expired.", http.StatusGone)
+}
+
+// limitReached removes a buffer that has hit its download limit from the
+// store and rejects the request.
+func (ob *onionbox) limitReached(w http.ResponseWriter, oBuffer *onion_buffer.OnionBuffer, fail errorFunc) {
+	if err := ob.store.Delete(oBuffer); err != nil {
+		ob.logf("Error deleting onion file from store: %v", err)
+	}
+	ob.logf("Download limit reached for %s", oBuffer.Name)
+	fail(w, "Download limit reached.", http.StatusUnauthorized)
+}
+
+// wrongPassword records a failed password attempt and destroys the buffer
+// once -maxattempts is reached.
+func (ob *onionbox) wrongPassword(w http.ResponseWriter, oBuffer *onion_buffer.OnionBuffer, fail errorFunc) {
+	failed := oBuffer.EndAttempt(true)
+	ob.logf("Wrong password for %s (%d failed attempts)", oBuffer.Name, failed)
+	if ob.maxAttempts > 0 && failed >= ob.maxAttempts {
+		if err := ob.store.Delete(oBuffer); err != nil {
+			ob.logf("Error deleting onion file from store: %v", err)
 		}
-	default:
-		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		fail(w, "Too many wrong passwords, the files have been destroyed.", http.StatusGone)
+		return
 	}
+	fail(w, "Wrong password.", http.StatusForbidden)
 }
 
-func createCSRF() (string, error) {
-	hasher := md5.New()
-	_, err := io.WriteString(hasher, strconv.FormatInt(time.Now().Unix(), 10))
+// maxFormValue caps the size of a single non-file form value.
+const maxFormValue = 64 << 10
+
+// readFormValue reads a non-file part of a multipart form.
+func readFormValue(part io.Reader) (string, error) {
+	value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValue+1))
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+	if len(value) > maxFormValue {
+		return "", fmt.Errorf("form value larger than %d bytes", maxFormValue)
+	}
+	return string(value), nil
+}
+
+// parseSmallForm parses a url-encoded form body of at most maxFormValue
+// bytes. Other bodies are refused before anything is read, so a large
+// multipart body is never spooled to disk by ParseMultipartForm. On
+// failure it responds with an error and returns false.
+func (ob *onionbox) parseSmallForm(w http.ResponseWriter, r *http.Request) bool {
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/x-www-form-urlencoded" {
+		http.Error(w, "Invalid Content-Type.", http.StatusUnsupportedMediaType)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormValue)
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Form too large.", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		http.Error(w, "Invalid form.", http.StatusBadRequest)
+		return false
+	}
+	return true
 }
 
 func (ob *onionbox) logf(format string, args ...interface{}) {
@@ -451,6 +1019,8 @@ func (ob *onionbox) logf(format string, args ...interface{}) {
 }
 
 func (ob *onionbox) destroy() {
+	ob.pending.destroyAll(ob)
+	ob.chats.destroyAll()
 	if err := ob.store.DestroyAll(); err != nil {
 		ob.logf("Error destroying all buffers from store: %v", err)
 	}
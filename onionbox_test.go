@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"onionbox/onion_buffer"
+)
+
+// fakeStore is a Store whose Add and Reserve fail with addErr and
+// reserveErr when they are set.
+type fakeStore struct {
+	sync.Mutex
+	buffers    map[string]*onion_buffer.OnionBuffer
+	addErr     error
+	reserveErr error
+	reserved   int64
+}
+
+var _ onion_buffer.Store = (*fakeStore)(nil)
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{buffers: make(map[string]*onion_buffer.OnionBuffer)}
+}
+
+func (s *fakeStore) Add(oBuffer *onion_buffer.OnionBuffer) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.addErr != nil {
+		return s.addErr
+	}
+	if _, ok := s.buffers[oBuffer.Name]; ok {
+		return onion_buffer.ErrBufferExists
+	}
+	s.buffers[oBuffer.Name] = oBuffer
+	return nil
+}
+
+func (s *fakeStore) Get(name string) *onion_buffer.OnionBuffer {
+	s.Lock()
+	defer s.Unlock()
+	return s.buffers[name]
+}
+
+func (s *fakeStore) Delete(oBuffer *onion_buffer.OnionBuffer) error {
+	s.Lock()
+	delete(s.buffers, oBuffer.Name)
+	s.Unlock()
+	return oBuffer.Destroy()
+}
+
+func (s *fakeStore) List() []*onion_buffer.OnionBuffer {
+	s.Lock()
+	defer s.Unlock()
+	buffers := make([]*onion_buffer.OnionBuffer, 0, len(s.buffers))
+	for _, f := range s.buffers {
+		buffers = append(buffers, f)
+	}
+	return buffers
+}
+
+func (s *fakeStore) Stats() onion_buffer.Stats {
+	s.Lock()
+	defer s.Unlock()
+	return onion_buffer.Stats{Buffers: len(s.buffers), Reserved: s.reserved}
+}
+
+func (s *fakeStore) Reserve(size int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.reserveErr != nil {
+		return s.reserveErr
+	}
+	s.reserved += size
+	return nil
+}
+
+func (s *fakeStore) Release(size int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.reserved -= size
+}
+
+func (s *fakeStore) DestroyAll() error {
+	s.Lock()
+	defer s.Unlock()
+	for name, f := range s.buffers {
+		f.Destroy()
+		delete(s.buffers, name)
+	}
+	return nil
+}
+
+func (s *fakeStore) SetExpiry(oBuffer *onion_buffer.OnionBuffer, expiresAt time.Time) {
+	oBuffer.Lock()
+	oBuffer.ExpiresAt = expiresAt
+	oBuffer.Unlock()
+}
+
+// newTestOnionbox returns an onionbox serving from store.
+func newTestOnionbox(store onion_buffer.Store) *onionbox {
+	return &onionbox{
+		store:        store,
+		pending:      newPendingUploads(),
+		chats:        newChatRooms(),
+		chat:         true,
+		maxMemory:    8,
+		chunkSize:    1024,
+		csrfKey:      make([]byte, 32),
+		baseURL:      "http://onionbox.test",
+		drainTimeout: time.Second,
+		stop:         make(chan struct{}),
+	}
+}
+
+// addTestBuffer stores a buffer named name holding a zip, expiring at
+// expiresAt unless it is zero.
+func addTestBuffer(t *testing.T, store onion_buffer.Store, name string, expiresAt time.Time) *onion_buffer.OnionBuffer {
+	t.Helper()
+	oBuffer := &onion_buffer.OnionBuffer{
+		Name:      name,
+		Bytes:     []byte("PK\x05\x06\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	chksm, err := oBuffer.GetChecksum()
+	if err != nil {
+		t.Fatalf("GetChecksum: %v", err)
+	}
+	oBuffer.Checksum = chksm
+	if err := store.Add(oBuffer); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	return oBuffer
+}
+
+// multipartUpload encodes form values followed by files as the upload
+// form sends them.
+func multipartUpload(t *testing.T, values map[string]string, files map[string]string) (io.Reader, string) {
+	t.Helper()
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for name, value := range values {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, content)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body, mw.FormDataContentType()
+}
+
+func TestLookupMissingAndExpired(t *testing.T) {
+	store := newFakeStore()
+	ob := newTestOnionbox(store)
+	h := ob.routes()
+	addTestBuffer(t, store, "live", time.Time{})
+	paths := []string{
+		"/d/%s",
+		"/d/%s/manifest",
+		"/d/%s/chat",
+		"/d/%s/chat/messages?after=0",
+		"/manage/%s?key=x",
+		apiPath + uploadsPath + "/%s",
+		apiPath + uploadsPath + "/%s/content",
+	}
+	for _, path := range paths {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, strings.Replace(path, "%s", "missing", 1), nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s for a missing buffer returned %d, want 404", path, rec.Code)
+		}
+		expired := addTestBuffer(t, store, "expired", time.Now().Add(-time.Minute))
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, strings.Replace(path, "%s", "expired", 1), nil))
+		if rec.Code != http.StatusGone {
+			t.Errorf("GET %s for an expired buffer returned %d, want 410", path, rec.Code)
+		}
+		if store.Get("expired") != nil || !expired.Destroyed() {
+			t.Errorf("GET %s left the expired buffer in the store", path)
+		}
+	}
+	if store.Get("live") == nil {
+		t.Error("live buffer was removed")
+	}
+}
+
+func TestUploadStoreFull(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*fakeStore)
+	}{
+		{"reserve", func(s *fakeStore) { s.reserveErr = onion_buffer.ErrStoreFull }},
+		{"add", func(s *fakeStore) { s.addErr = onion_buffer.ErrStoreFull }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			tt.setup(store)
+			h := newTestOnionbox(store).routes()
+			body, contentType := multipartUpload(t, nil, map[string]string{"a.txt": "hello"})
+			req := httptest.NewRequest(http.MethodPost, apiPath+uploadsPath, body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set(apiHeader, "1")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusInsufficientStorage {
+				t.Errorf("upload returned %d, want 507", rec.Code)
+			}
+			if len(store.List()) != 0 {
+				t.Error("upload was stored")
+			}
+			if store.reserved != 0 {
+				t.Errorf("%d bytes left reserved", store.reserved)
+			}
+		})
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	store := newFakeStore()
+	ob := newTestOnionbox(store)
+	ob.maxMemory = 1
+	h := ob.routes()
+	body, contentType := multipartUpload(t, nil, map[string]string{"big.bin": strings.Repeat("x", 2<<20)})
+	req := httptest.NewRequest(http.MethodPost, apiPath+uploadsPath, body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(apiHeader, "1")
+	// Send it without a length so the cap trips while reading
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload returned %d, want 413", rec.Code)
+	}
+	if store.reserved != 0 {
+		t.Errorf("%d bytes left reserved", store.reserved)
+	}
+}
+
+func TestFinishedUploadsArentPending(t *testing.T) {
+	ob := newTestOnionbox(newFakeStore())
+	h := ob.routes()
+	var location string
+	// Empty uploads finish as soon as they are created
+	for i := 0; i <= maxPendingUploads; i++ {
+		req := httptest.NewRequest(http.MethodPost, uploadsPath, nil)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Length", "0")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("creating upload %d returned %d, want 201", i, rec.Code)
+		}
+		if rec.Header().Get("Onionbox-Manage-Url") == "" {
+			t.Fatalf("upload %d was finished without a management link", i)
+		}
+		location = rec.Header().Get("Location")
+	}
+	// A client that lost the final response gets the share link back,
+	// but not the management token
+	req := httptest.NewRequest(http.MethodHead, location, nil)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Onionbox-Share-Url") == "" {
+		t.Errorf("HEAD of a finished upload returned %d with share link %q", rec.Code, rec.Header().Get("Onionbox-Share-Url"))
+	}
+	if rec.Header().Get("Onionbox-Manage-Url") != "" {
+		t.Error("HEAD of a finished upload returned the management link")
+	}
+	ob.pending.sweep(ob, time.Now().Add(finishedTimeout+time.Minute))
+	if ob.pending.get(strings.TrimPrefix(location, uploadsPath+"/")) != nil {
+		t.Error("finished upload was kept past finishedTimeout")
+	}
+}
+
+func TestPlainGetNotCutShort(t *testing.T) {
+	store := newFakeStore()
+	h := newTestOnionbox(store).routes()
+	oBuffer := addTestBuffer(t, store, "limited", time.Time{})
+	oBuffer.DownloadsLimited = true
+	oBuffer.DownloadLimit = 1
+	size := int64(len(oBuffer.Bytes))
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/d/limited", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get("bytes=0-9"); rec.Code != http.StatusPartialContent {
+		t.Fatalf("first range returned %d, want 206", rec.Code)
+	}
+	// The rest of the allowance can't cover the whole zip
+	rec := get("")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("plain GET after a range returned %d with %d of %d bytes, want 416", rec.Code, rec.Body.Len(), size)
+	}
+	rec = get("bytes=10-")
+	if rec.Code != http.StatusPartialContent || int64(rec.Body.Len()) != size-10 {
+		t.Errorf("resuming returned %d with %d bytes, want 206 with %d", rec.Code, rec.Body.Len(), size-10)
+	}
+	if store.Get("limited") != nil {
+		t.Error("buffer was kept after its only download was delivered")
+	}
+}
+
+func TestAPIRefusesFormPosts(t *testing.T) {
+	store := newFakeStore()
+	h := newTestOnionbox(store).routes()
+	// What a cross-site form can send
+	body, contentType := multipartUpload(t, nil, map[string]string{"a.txt": "hello"})
+	req := httptest.NewRequest(http.MethodPost, apiPath+uploadsPath, body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("upload without %s returned %d, want 403", apiHeader, rec.Code)
+	}
+	if len(store.List()) != 0 {
+		t.Error("upload was stored")
+	}
+}
+
+func TestSmallFormsOnly(t *testing.T) {
+	store := newFakeStore()
+	h := newTestOnionbox(store).routes()
+	token, err := addTestBuffer(t, store, "live", time.Time{}).NewToken()
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+	multipartBody, multipartType := multipartUpload(t, map[string]string{"token": "x"}, nil)
+	multipartData, err := ioutil.ReadAll(multipartBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"multipart", multipartType, string(multipartData), http.StatusUnsupportedMediaType},
+		{"too large", "application/x-www-form-urlencoded", "text=" + strings.Repeat("x", maxFormValue), http.StatusRequestEntityTooLarge},
+	}
+	paths := []string{"/d/live", "/d/live/chat", "/manage/live?key=" + token}
+	for _, tt := range tests {
+		for _, path := range paths {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s POST to %s returned %d, want %d", tt.name, path, rec.Code, tt.want)
+			}
+		}
+	}
+}
+
+func TestUploadInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+	}{
+		{"download limit", map[string]string{"limit_downloads": "on", "download_limit": "x"}},
+		{"negative download limit", map[string]string{"limit_downloads": "on", "download_limit": "-1"}},
+		{"expiration time", map[string]string{"expire": "on", "expiration_time": "x"}},
+		{"negative expiration time", map[string]string{"expire": "on", "expiration_time": "-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			h := newTestOnionbox(store).routes()
+			body, contentType := multipartUpload(t, tt.values, map[string]string{"a.txt": "hello"})
+			req := httptest.NewRequest(http.MethodPost, apiPath+uploadsPath, body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set(apiHeader, "1")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("upload returned %d, want 400", rec.Code)
+			}
+			if len(store.List()) != 0 {
+				t.Error("upload was stored")
+			}
+		})
+	}
+}
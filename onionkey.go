@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"golang.org/x/crypto/ssh/terminal"
+	"onionbox/onion_buffer"
+)
+
+// Onion keys are saved in the format of Tor's hs_ed25519_secret_key file,
+// so they can be moved between onionbox and a standalone Tor, and are
+// sealed with onion_buffer.Encrypt when a passphrase is used.
+var torKeyHeader = []byte("== ed25519v1-secret: type0 ==\x00\x00\x00")
+
+// keyPassphraseEnv supplies the key file passphrase without a prompt, for
+// running as a service.
+const keyPassphraseEnv = "ONIONBOX_KEY_PASSPHRASE"
+
+// loadOnionKey reads the v3 onion service key in path, creating it with a
+// new key if it doesn't exist yet. The file must only be accessible by its
+// owner. If encrypted is set the key is sealed with a passphrase, and an
+// existing key must have been.
+func loadOnionKey(path string, encrypted bool) (ed25519.KeyPair, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return createOnionKey(path, encrypted)
+	} else if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key file %s can be accessed by other users, restrict it with chmod 600", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer onion_buffer.Wipe(data)
+	if bytes.HasPrefix(data, torKeyHeader) {
+		// Don't let -keypass suggest a plaintext key is protected
+		if encrypted {
+			return nil, fmt.Errorf("key file %s is not encrypted, run without -keypass or move it aside to create an encrypted key", path)
+		}
+	} else {
+		pass, err := keyPassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := onion_buffer.Decrypt(data, pass)
+		if err == onion_buffer.ErrWrongPassword {
+			return nil, fmt.Errorf("wrong passphrase for key file %s", path)
+		} else if err != nil {
+			return nil, fmt.Errorf("reading key file %s: %v", path, err)
+		}
+		defer onion_buffer.Wipe(plain)
+		data = plain
+	}
+	if len(data) != len(torKeyHeader)+64 || !bytes.HasPrefix(data, torKeyHeader) {
+		return nil, fmt.Errorf("key file %s is not an ed25519 onion service key", path)
+	}
+	key := make(ed25519.PrivateKey, 64)
+	copy(key, data[len(torKeyHeader):])
+	return key.KeyPair(), nil
+}
+
+// createOnionKey generates a new key and writes it to path, which must not
+// exist yet.
+func createOnionKey(path string, encrypted bool) (ed25519.KeyPair, error) {
+	keyPair, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data := append(append([]byte{}, torKeyHeader...), keyPair.PrivateKey()...)
+	defer onion_buffer.Wipe(data)
+	if encrypted {
+		pass, err := keyPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = onion_buffer.Encrypt(data, pass); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return keyPair, nil
+}
+
+// keyPassphrase returns the key file passphrase, asking for it twice if
+// confirm is set.
+func keyPassphrase(confirm bool) (string, error) {
+	return passphrase(keyPassphraseEnv, "Onion key passphrase: ", confirm)
+}
+
+// passphrase returns the passphrase in the environment variable env or,
+// failing that, asks for it on the terminal, twice if confirm is set.
+func passphrase(env, prompt string, confirm bool) (string, error) {
+	if pass := os.Getenv(env); pass != "" {
+		return pass, nil
+	}
+	pass, err := readPassword(prompt)
+	if err != nil {
+		return "", fmt.Errorf("%v, set %s to pass it in", err, env)
+	}
+	if pass == "" {
+		return "", errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := readPassword("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != pass {
+			return "", errors.New("passphrases don't match")
+		}
+	}
+	return pass, nil
+}
+
+// readPassword prompts for a password on the terminal without echoing it.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", errors.New("can't prompt for a password, stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A publisher makes onionbox reachable. Normally that is an onion service,
+// a local listener serves the same handlers without Tor for development
+// and testing, and tests can supply their own.
+type publisher interface {
+	// Listen returns the listener to serve on and the base URL clients
+	// reach it at, such as http://<id>.onion.
+	Listen(ctx context.Context) (net.Listener, string, error)
+	// Close tears down whatever Listen set up. The listener itself is
+	// closed by the server.
+	Close() error
+}
+
+// localPublisher serves on a plain TCP address, or a Unix socket given as
+// unix:/path/to/socket.
+type localPublisher struct {
+	address string
+}
+
+func (lp *localPublisher) Listen(ctx context.Context) (net.Listener, string, error) {
+	network, address := "tcp", lp.address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, "", err
+	}
+	// Clients of a Unix socket choose their own host name
+	if network == "unix" {
+		return ln, "http://localhost", nil
+	}
+	return ln, fmt.Sprintf("http://%s", ln.Addr()), nil
+}
+
+func (lp *localPublisher) Close() error {
+	return nil
+}
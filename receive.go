@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"onionbox/onion_buffer"
+	"onionbox/templates"
+)
+
+// In receive mode onionbox is a drop box: anyone with the onion address can
+// upload files, but uploads don't get a download or management link and
+// nobody but the operator can get them back. Submissions are listed on an
+// admin page, and in the API for scripts, behind an admin key that is
+// created on start and printed with the onion address.
+//
+//	GET    /admin?key=<key>                    list submissions
+//	GET    /admin/{name}?key=<key>             download a submission
+//	GET    /api/v1/submissions                 list submissions as JSON
+//	GET    /api/v1/submissions/{name}/content  download a submission
+//	DELETE /api/v1/submissions/{name}          destroy a submission
+//
+// The API takes the admin key as "Authorization: Bearer <key>".
+const (
+	adminPath       = "/admin"
+	submissionsPath = "/submissions"
+)
+
+// receiveRoutes registers the admin pages and API used to collect
+// submissions in place of the download, management and upload APIs.
+func (ob *onionbox) receiveRoutes(m *mux) {
+	m.handle(adminPath, ob.admin, http.MethodGet)
+	m.handle(adminPath+"/{id}", ob.adminSubmission, http.MethodGet, http.MethodHead, http.MethodPost)
+	m.handleErrors(apiPath, ob.apiError)
+	m.handle(apiPath+submissionsPath, ob.apiSubmissions, http.MethodGet, http.MethodHead)
+	m.handle(apiPath+submissionsPath+"/{id}/content", ob.apiSubmissionContent, http.MethodGet, http.MethodHead)
+	m.handle(apiPath+submissionsPath+"/{id}", ob.apiSubmissionDelete, http.MethodDelete)
+}
+
+// createAdminKey returns a new random admin key.
+func createAdminKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// adminURL returns the link the operator uses to collect submissions.
+func (ob *onionbox) adminURL() string {
+	return fmt.Sprintf("%s%s?key=%s", ob.baseURL, adminPath, url.QueryEscape(ob.adminKey))
+}
+
+// validAdminKey reports whether key is the admin key.
+func (ob *onionbox) validAdminKey(key string) bool {
+	return subtle.ConstantTimeCompare([]byte(key), []byte(ob.adminKey)) == 1
+}
+
+func (ob *onionbox) admin(w http.ResponseWriter, r *http.Request) {
+	// Don't tell the admin page apart from a missing page without the key
+	if !ob.validAdminKey(r.URL.Query().Get("key")) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	csrf, err := ob.createCSRF(w, r)
+	if err != nil {
+		ob.logf("Error creating CSRF token: %v", err)
+		http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+	// Parse template
+	t, err := template.New("admin").Parse(templates.AdminHTML)
+	if err != nil {
+		ob.logf("Error loading template: %v", err)
+		http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+	// Execute template
+	data := struct {
+		Submissions []apiUpload
+		Key         string
+		Token       string
+	}{ob.submissions(), ob.adminKey, csrf}
+	if err := t.Execute(w, data); err != nil {
+		ob.logf("Error executing template: %v", err)
+		http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (ob *onionbox) adminSubmission(w http.ResponseWriter, r *http.Request) {
+	oBuffer := ob.store.Get(param(r, "id"))
+	if oBuffer == nil || !ob.validAdminKey(r.URL.Query().Get("key")) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		content, done := ob.openContent(w, oBuffer, "", http.Error)
+		if content == nil {
+			return
+		}
+		defer done()
+		ob.serveBuffer(w, r, oBuffer, content, http.Error)
+	case http.MethodPost:
+		if !ob.parseSmallForm(w, r) {
+			return
+		}
+		// The key travels in the URL, so read the token from the body only
+		if !ob.validCSRF(r, r.PostFormValue("token")) {
+			ob.forbidCSRF(w)
+			return
+		}
+		if err := ob.store.Delete(oBuffer); err != nil {
+			ob.logf("Error deleting onion file from store: %v", err)
+			http.Error(w, "Error destroying files.", http.StatusInternalServerError)
+			return
+		}
+		ob.logf("Submission %s destroyed by the operator", oBuffer.Name)
+		// Back to the remaining submissions
+		http.Redirect(w, r, adminPath+"?key="+url.QueryEscape(ob.adminKey), http.StatusSeeOther)
+	default:
+		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ob *onionbox) apiSubmissions(w http.ResponseWriter, r *http.Request) {
+	if ob.apiAdmin(w, r) {
+		ob.writeJSON(w, http.StatusOK, ob.submissions())
+	}
+}
+
+func (ob *onionbox) apiSubmissionContent(w http.ResponseWriter, r *http.Request) {
+	if !ob.apiAdmin(w, r) {
+		return
+	}
+	oBuffer := ob.lookup(w, r, ob.apiError)
+	if oBuffer == nil {
+		return
+	}
+	content, done := ob.openContent(w, oBuffer, "", ob.apiError)
+	if content == nil {
+		return
+	}
+	defer done()
+	ob.serveBuffer(w, r, oBuffer, content, ob.apiError)
+}
+
+func (ob *onionbox) apiSubmissionDelete(w http.ResponseWriter, r *http.Request) {
+	if !ob.apiAdmin(w, r) {
+		return
+	}
+	oBuffer := ob.lookup(w, r, ob.apiError)
+	if oBuffer == nil {
+		return
+	}
+	if err := ob.store.Delete(oBuffer); err != nil {
+		ob.logf("Error deleting onion file from store: %v", err)
+		ob.apiError(w, "Error deleting submission.", http.StatusInternalServerError)
+		return
+	}
+	ob.logf("Submission %s deleted by the operator", oBuffer.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiAdmin checks the request's bearer token against the admin key,
+// rejecting the request if it doesn't match.
+func (ob *onionbox) apiAdmin(w http.ResponseWriter, r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		ob.apiError(w, "Admin key required.", http.StatusUnauthorized)
+		return false
+	}
+	if !ob.validAdminKey(strings.TrimPrefix(auth, "Bearer ")) {
+		ob.apiError(w, "Invalid admin key.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// submissions describes every submission in the store, oldest first. Their
+// URLs point at the admin API rather than a share link.
+func (ob *onionbox) submissions() []apiUpload {
+	buffers := ob.store.List()
+	list := make([]apiUpload, 0, len(buffers))
+	for _, oBuffer := range buffers {
+		if oBuffer.IsExpired() {
+			continue
+		}
+		upload := ob.describe(oBuffer)
+		upload.URL = fmt.Sprintf("%s%s%s/%s/content", ob.baseURL, apiPath, submissionsPath, oBuffer.Name)
+		list = append(list, upload)
+	}
+	return list
+}
+
+// receivedSubmission is what a sender is told once their files are
+// stored, nothing that would let them or anyone else find the files again.
+func (ob *onionbox) receivedSubmission(w http.ResponseWriter, oBuffer *onion_buffer.OnionBuffer) {
+	ob.logf("Submission %s received", oBuffer.Name)
+	if _, err := w.Write([]byte("Files received, thank you. Only the operator of this onionbox can access them.")); err != nil {
+		ob.logf("Error writing to client: %v", err)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"onionbox/onion_buffer"
+)
+
+// Resumable uploads implement the core of the tus 1.0 protocol with its
+// creation and termination extensions, see https://tus.io/protocols/resumable-upload.html.
+// A client creates an upload with a POST to /uploads, then sends the file
+// in as many PATCH requests as it takes, asking for the current offset
+// with HEAD after losing its connection. Upload options are passed as
+// Upload-Metadata keys: filename, password, download_limit and
+// expiration_time (in minutes). Once every byte has arrived the file is
+// zipped, encrypted if a password was given, and stored like a form
+// upload; the share link is returned in the Onionbox-Share-Url header and
+// the uploader's management link in Onionbox-Manage-Url. Only the share
+// link is given again to a client asking after the final response.
+const (
+	tusVersion  = "1.0.0"
+	uploadsPath = "/uploads"
+	// Unfinished uploads are dropped after this long without activity,
+	// checked every pendingSweepInterval
+	pendingTimeout       = 24 * time.Hour
+	pendingSweepInterval = time.Minute
+	// Finished uploads are remembered this long for clients that lost
+	// the final response
+	finishedTimeout = 10 * time.Minute
+	// At most this many uploads can be unfinished at once
+	maxPendingUploads = 64
+	// Smallest step an upload's buffer grows by as its bytes arrive
+	uploadGrowStep = 64 << 10
+)
+
+// pendingUpload is an upload still being received. Its bytes accumulate
+// in an OnionBuffer that isn't in the store yet.
+type pendingUpload struct {
+	sync.Mutex
+	id         string
+	buffer     *onion_buffer.OnionBuffer
+	length     int64
+	reserved   bool
+	filename   string
+	form       url.Values
+	shareName  string
+	lastActive time.Time
+}
+
+// pendingUploads holds every unfinished upload by ID, and recently
+// finished ones apart so they don't count against maxPendingUploads.
+type pendingUploads struct {
+	sync.Mutex
+	uploads  map[string]*pendingUpload
+	finished map[string]*pendingUpload
+	// done is closed to stop the sweeper
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newPendingUploads() *pendingUploads {
+	return &pendingUploads{
+		uploads:  make(map[string]*pendingUpload),
+		finished: make(map[string]*pendingUpload),
+		done:     make(chan struct{}),
+	}
+}
+
+func (ob *onionbox) resumable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(ob.maxMemory<<20, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version.", http.StatusPreconditionFailed)
+		return
+	}
+	id := param(r, "id")
+	if id == "" {
+		ob.createUpload(w, r)
+		return
+	}
+	upload := ob.pending.get(id)
+	if upload == nil {
+		http.Error(w, "Upload not found.", http.StatusNotFound)
+		return
+	}
+	upload.Lock()
+	defer upload.Unlock()
+	switch r.Method {
+	case http.MethodHead:
+		ob.uploadOffset(w, upload)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		ob.patchUpload(w, r, upload)
+	case http.MethodDelete:
+		ob.pending.remove(id)
+		ob.discardUpload(upload)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ob *onionbox) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length.", http.StatusBadRequest)
+		return
+	}
+	if length > ob.maxMemory<<20 {
+		ob.uploadTooLarge(w, http.Error)
+		return
+	}
+	filename, form, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		ob.logf("Error parsing upload metadata: %v", err)
+		http.Error(w, "Invalid Upload-Metadata.", http.StatusBadRequest)
+		return
+	}
+	// Drop abandoned uploads before asking for more of the budget
+	ob.pending.sweep(ob, time.Now())
+	if ob.pending.count() >= maxPendingUploads {
+		ob.logf("Refusing upload, %d uploads are already in progress", maxPendingUploads)
+		http.Error(w, "Too many uploads in progress, please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	if err := ob.store.Reserve(length); err == onion_buffer.ErrStoreFull {
+		http.Error(w, "Not enough space to store files.", http.StatusInsufficientStorage)
+		return
+	} else if err != nil {
+		ob.logf("Error reserving store space: %v", err)
+		http.Error(w, "Error creating upload.", http.StatusInternalServerError)
+		return
+	}
+	id, err := createUploadID()
+	if err != nil {
+		ob.store.Release(length)
+		ob.logf("Error creating upload ID: %v", err)
+		http.Error(w, "Error creating upload.", http.StatusInternalServerError)
+		return
+	}
+	// The buffer grows as the bytes arrive, so creating uploads doesn't
+	// take any memory
+	upload := &pendingUpload{
+		id:         id,
+		buffer:     &onion_buffer.OnionBuffer{Name: id, CreatedAt: time.Now()},
+		length:     length,
+		reserved:   true,
+		filename:   filename,
+		form:       form,
+		lastActive: time.Now(),
+	}
+	upload.Lock()
+	defer upload.Unlock()
+	ob.pending.add(upload)
+	w.Header().Set("Location", uploadsPath+"/"+id)
+	// An empty file is complete as soon as it is created
+	if length == 0 && !ob.finishUpload(w, upload) {
+		return
+	}
+	ob.uploadOffset(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (ob *onionbox) patchUpload(w http.ResponseWriter, r *http.Request, upload *pendingUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset.", http.StatusBadRequest)
+		return
+	}
+	if upload.shareName != "" || offset != int64(len(upload.buffer.Bytes)) {
+		ob.uploadOffset(w, upload)
+		http.Error(w, "Upload-Offset does not match.", http.StatusConflict)
+		return
+	}
+	// Read straight into the buffer's spare capacity, keeping whatever
+	// arrives before the connection drops so the client can resume
+	data := upload.buffer.Bytes
+	for int64(len(data)) < upload.length {
+		if len(data) == cap(data) {
+			data = ob.growUpload(data, upload.length)
+			upload.buffer.Bytes = data
+		}
+		n, err := r.Body.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ob.logf("Error reading upload %s: %v", upload.id, err)
+			break
+		}
+	}
+	upload.buffer.Bytes = data
+	if int64(len(data)) == upload.length && !ob.finishUpload(w, upload) {
+		return
+	}
+	ob.uploadOffset(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload zips a completely received upload and adds it to the
+// store. On failure it responds with an error and returns false.
+func (ob *onionbox) finishUpload(w http.ResponseWriter, upload *pendingUpload) bool {
+	// The finished zip takes the place of the reservation in the budget
+	defer ob.discardUpload(upload)
+	zipBuffer := new(bytes.Buffer)
+	var zipOut io.Writer = zipBuffer
+	var encWriter *onion_buffer.EncryptWriter
+	if upload.form.Get("password_enabled") == "on" {
+		var err error
+		encWriter, err = onion_buffer.NewEncryptWriter(zipBuffer, upload.form.Get("password"))
+		if err != nil {
+			ob.pending.remove(upload.id)
+			ob.logf("Error encrypting buffer: %v", err)
+			http.Error(w, "Error encrypting buffer.", http.StatusInternalServerError)
+			return false
+		}
+		defer encWriter.Close()
+		zipOut = encWriter
+	}
+	zWriter := zip.NewWriter(zipOut)
+	bufFile, err := zWriter.Create(upload.filename)
+	if err == nil {
+		_, err = bufFile.Write(upload.buffer.Bytes)
+	}
+	if err == nil {
+		err = zWriter.Close()
+	}
+	if err == nil && encWriter != nil {
+		err = encWriter.Close()
+	}
+	if err != nil {
+		onion_buffer.Wipe(zipBuffer.Bytes())
+		ob.pending.remove(upload.id)
+		ob.logf("Error writing file to zip: %v", err)
+		http.Error(w, "Error writing file to zip", http.StatusInternalServerError)
+		return false
+	}
+	ob.store.Release(upload.length)
+	upload.reserved = false
+	oBuffer, token := ob.storeBuffer(w, zipBuffer.Bytes(), encWriter != nil, upload.form, http.Error)
+	if oBuffer == nil {
+		ob.pending.remove(upload.id)
+		return false
+	}
+	// The management token is only sent once, the finished upload is
+	// kept without it so a client that lost the final response can
+	// still find the share link
+	w.Header().Set("Onionbox-Manage-Url", ob.manageURL(oBuffer.Name, token))
+	upload.shareName = oBuffer.Name
+	ob.pending.finish(upload)
+	return true
+}
+
+// growUpload returns data moved to a bigger buffer, doubling its size up
+// to the upload's length. The old buffer is wiped.
+func (ob *onionbox) growUpload(data []byte, length int64) []byte {
+	size := int64(cap(data)) * 2
+	if size < uploadGrowStep {
+		size = uploadGrowStep
+	}
+	if size > length {
+		size = length
+	}
+	grown := make([]byte, len(data), size)
+	// Lock memory allotted to the upload from being used in SWAP
+	if err := syscall.Mlock(grown[:size]); err != nil {
+		ob.logf("Error mlocking allotted memory for upload: %v", err)
+	}
+	copy(grown, data)
+	onion_buffer.Wipe(data)
+	if cap(data) > 0 {
+		if err := syscall.Munlock(data[:cap(data)]); err != nil {
+			ob.logf("Error munlocking upload memory: %v", err)
+		}
+	}
+	return grown
+}
+
+// discardUpload wipes an upload's bytes and releases its reservation.
+func (ob *onionbox) discardUpload(upload *pendingUpload) {
+	if err := upload.buffer.Destroy(); err != nil {
+		ob.logf("Error destroying upload %s: %v", upload.id, err)
+	}
+	if upload.reserved {
+		ob.store.Release(upload.length)
+		upload.reserved = false
+	}
+}
+
+// uploadOffset sets the headers describing an upload's progress.
+func (ob *onionbox) uploadOffset(w http.ResponseWriter, upload *pendingUpload) {
+	offset := int64(len(upload.buffer.Bytes))
+	if upload.shareName != "" {
+		offset = upload.length
+		w.Header().Set("Onionbox-Share-Url", ob.shareURL(upload.shareName))
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+}
+
+func (p *pendingUploads) add(upload *pendingUpload) {
+	p.Lock()
+	defer p.Unlock()
+	p.uploads[upload.id] = upload
+}
+
+// get returns the upload with the given ID, finished or not. Unfinished
+// uploads are marked as active.
+func (p *pendingUploads) get(id string) *pendingUpload {
+	p.Lock()
+	defer p.Unlock()
+	if upload := p.uploads[id]; upload != nil {
+		upload.lastActive = time.Now()
+		return upload
+	}
+	return p.finished[id]
+}
+
+// finish moves an upload to the finished ones, which are forgotten
+// finishedTimeout later.
+func (p *pendingUploads) finish(upload *pendingUpload) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.uploads, upload.id)
+	upload.lastActive = time.Now()
+	p.finished[upload.id] = upload
+}
+
+func (p *pendingUploads) remove(id string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.uploads, id)
+	delete(p.finished, id)
+}
+
+// count returns the number of unfinished uploads.
+func (p *pendingUploads) count() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.uploads)
+}
+
+// startSweeper sweeps abandoned uploads every pendingSweepInterval until
+// stopSweeper is called.
+func (p *pendingUploads) startSweeper(ob *onionbox) {
+	go func() {
+		ticker := time.NewTicker(pendingSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				p.sweep(ob, now)
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *pendingUploads) stopSweeper() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+// sweep discards uploads that have been inactive for longer than
+// pendingTimeout, and forgets those finished more than finishedTimeout
+// ago.
+func (p *pendingUploads) sweep(ob *onionbox, now time.Time) {
+	p.Lock()
+	stale := make([]*pendingUpload, 0)
+	for id, upload := range p.uploads {
+		if now.Sub(upload.lastActive) > pendingTimeout {
+			delete(p.uploads, id)
+			stale = append(stale, upload)
+		}
+	}
+	for id, upload := range p.finished {
+		if now.Sub(upload.lastActive) > finishedTimeout {
+			delete(p.finished, id)
+		}
+	}
+	p.Unlock()
+	for _, upload := range stale {
+		upload.Lock()
+		ob.discardUpload(upload)
+		upload.Unlock()
+	}
+}
+
+// destroyAll wipes every pending upload.
+func (p *pendingUploads) destroyAll(ob *onionbox) {
+	p.Lock()
+	uploads := p.uploads
+	p.uploads = make(map[string]*pendingUpload)
+	p.finished = make(map[string]*pendingUpload)
+	p.Unlock()
+	for _, upload := range uploads {
+		upload.Lock()
+		ob.discardUpload(upload)
+		upload.Unlock()
+	}
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header into the file
+// name and the same option values the upload form sends.
+func parseUploadMetadata(header string) (string, url.Values, error) {
+	filename := "upload"
+	form := make(url.Values)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.Fields(pair)
+		var value []byte
+		if len(fields) > 1 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return "", nil, fmt.Errorf("decoding %s: %v", fields[0], err)
+			}
+		}
+		switch fields[0] {
+		case "filename":
+			if len(value) > 0 {
+				// Keep only the base name so the zip entry can't be
+				// extracted outside the recipient's directory
+				name := path.Base(strings.Replace(string(value), "\\", "/", -1))
+				if name == "." || name == ".." || name == "/" {
+					return "", nil, fmt.Errorf("invalid filename %q", value)
+				}
+				filename = name
+			}
+		case "password":
+			if len(value) > 0 {
+				form.Set("password_enabled", "on")
+				form.Set("password", string(value))
+			}
+		case "download_limit":
+			if _, err := strconv.Atoi(string(value)); err != nil {
+				return "", nil, fmt.Errorf("invalid download_limit: %v", err)
+			}
+			form.Set("limit_downloads", "on")
+			form.Set("download_limit", string(value))
+		case "expiration_time":
+			if _, err := strconv.Atoi(string(value)); err != nil {
+				return "", nil, fmt.Errorf("invalid expiration_time: %v", err)
+			}
+			form.Set("expire", "on")
+			form.Set("expiration_time", string(value))
+		}
+	}
+	return filename, form, nil
+}
+
+// createUploadID returns a random ID for a pending upload. Knowing it is
+// enough to add to or cancel the upload, so it must be unguessable.
+func createUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// mux routes requests by method and path. Patterns are matched a path
+// segment at a time, a {name} segment matches any single segment and is
+// passed to the handler in the request context, see param. A final
+// {name...} segment matches the rest of the path, however many segments
+// that is, including none. Middleware wraps every response, including the
+// mux's own 404 and 405 errors.
+type mux struct {
+	routes     []route
+	middleware []middleware
+	// fail responds to unmatched requests under a path prefix, so API
+	// clients get JSON errors
+	fail map[string]errorFunc
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	methods  []string
+	handler  http.HandlerFunc
+}
+
+// middleware wraps a handler with behaviour shared by every route.
+type middleware func(http.Handler) http.Handler
+
+type contextKey int
+
+const (
+	paramsKey contextKey = iota
+	patternKey
+)
+
+func newMux() *mux {
+	return &mux{fail: make(map[string]errorFunc)}
+}
+
+// handle registers handler for pattern and methods. A pattern may be
+// registered more than once with different methods.
+func (m *mux) handle(pattern string, handler http.HandlerFunc, methods ...string) {
+	m.routes = append(m.routes, route{
+		pattern:  pattern,
+		segments: strings.Split(strings.Trim(pattern, "/"), "/"),
+		methods:  methods,
+		handler:  handler,
+	})
+}
+
+// use appends middleware, the first added is the outermost.
+func (m *mux) use(mw ...middleware) {
+	m.middleware = append(m.middleware, mw...)
+}
+
+// handleErrors sets how unmatched requests under prefix are answered.
+func (m *mux) handleErrors(prefix string, fail errorFunc) {
+	m.fail[prefix] = fail
+}
+
+func (m *mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var allowed []string
+	for _, rt := range m.routes {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		if !hasMethod(rt.methods, r.Method) {
+			allowed = append(allowed, rt.methods...)
+			continue
+		}
+		ctx := context.WithValue(r.Context(), paramsKey, params)
+		ctx = context.WithValue(ctx, patternKey, rt.pattern)
+		m.serve(w, r.WithContext(ctx), rt.handler)
+		return
+	}
+	fail := m.errorFunc(r.URL.Path)
+	if allowed != nil {
+		m.serve(w, r, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			fail(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		})
+		return
+	}
+	m.serve(w, r, func(w http.ResponseWriter, r *http.Request) {
+		fail(w, "404 page not found", http.StatusNotFound)
+	})
+}
+
+// serve runs handler inside the middleware chain.
+func (m *mux) serve(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	var h http.Handler = handler
+	for i := len(m.middleware) - 1; i >= 0; i-- {
+		h = m.middleware[i](h)
+	}
+	h.ServeHTTP(w, r)
+}
+
+// errorFunc returns the error responder for path, the one registered for
+// the longest matching prefix or http.Error.
+func (m *mux) errorFunc(path string) errorFunc {
+	fail, longest := errorFunc(http.Error), -1
+	for prefix, f := range m.fail {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			fail, longest = f, len(prefix)
+		}
+	}
+	return fail
+}
+
+func (rt route) match(segments []string) (map[string]string, bool) {
+	last := rt.segments[len(rt.segments)-1]
+	rest := strings.HasPrefix(last, "{") && strings.HasSuffix(last, "...}")
+	if len(segments) != len(rt.segments) && (!rest || len(segments) < len(rt.segments)-1) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, s := range rt.segments {
+		if rest && i == len(rt.segments)-1 {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-4]] = strings.Join(segments[i:], "/")
+		} else if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// param returns the path parameter name matched by the request's route.
+func param(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey).(map[string]string)
+	return params[name]
+}
+
+// routePattern returns the pattern of the route that matched the request,
+// or "" if none did.
+func routePattern(r *http.Request) string {
+	pattern, _ := r.Context().Value(patternKey).(string)
+	return pattern
+}
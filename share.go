@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"onionbox/onion_buffer"
+)
+
+// sharePasswordEnv supplies the password of an encrypted share without a
+// prompt.
+const sharePasswordEnv = "ONIONBOX_SHARE_PASSWORD"
+
+// shareOptions configures onionbox share, which serves local files and
+// directories as a single download instead of taking uploads, and shuts
+// down once the download limit is reached or the link expires.
+type shareOptions struct {
+	paths   []string
+	encrypt bool
+	limit   int
+	// expire is the minutes until the link expires, 0 for never
+	expire int
+	// name is the shared buffer's name once it is in the store
+	name string
+}
+
+func (opts *shareOptions) flags(fs *flag.FlagSet) {
+	fs.BoolVar(&opts.encrypt, "encrypt", false, "protect the share with a password, asked for on start or read "+
+		"from "+sharePasswordEnv)
+	fs.IntVar(&opts.limit, "limit", 0, "downloads allowed before the share is destroyed, 0 for no limit")
+	fs.IntVar(&opts.expire, "expire", 0, "minutes until the link expires, 0 for never")
+}
+
+// createShare zips the shared paths into a buffer and adds it to the
+// store.
+func (ob *onionbox) createShare() error {
+	opts := ob.share
+	if len(opts.paths) == 0 {
+		return errors.New("nothing to share, give the files or directories to share")
+	}
+	if opts.limit < 0 || opts.expire < 0 {
+		return errInvalidUpdate
+	}
+	// Create buffer for the zip file
+	zipBuffer := new(bytes.Buffer)
+	// Lock memory allotted to zipBuffer from being used in SWAP
+	if err := syscall.Mlock(zipBuffer.Bytes()); err != nil {
+		ob.logf("Error mlocking allotted memory for zipBuffer: %v", err)
+	}
+	// Wipe the zip if it doesn't make it into the store
+	stored := false
+	defer func() {
+		if !stored {
+			onion_buffer.Wipe(zipBuffer.Bytes())
+		}
+	}()
+	chunk := make([]byte, ob.chunkSize)
+	defer onion_buffer.Wipe(chunk)
+	var zipOut io.Writer = zipBuffer
+	var encWriter *onion_buffer.EncryptWriter
+	if opts.encrypt {
+		pass, err := passphrase(sharePasswordEnv, "Share password: ", true)
+		if err != nil {
+			return err
+		}
+		if encWriter, err = onion_buffer.NewEncryptWriter(zipBuffer, pass); err != nil {
+			return err
+		}
+		defer encWriter.Close()
+		zipOut = encWriter
+	}
+	zWriter := zip.NewWriter(zipOut)
+	names := make(map[string]bool)
+	for _, path := range opts.paths {
+		if err := zipPath(zWriter, path, names, chunk); err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("no files to share")
+	}
+	if err := zWriter.Close(); err != nil {
+		return err
+	}
+	// Seal the final encrypted chunk
+	if encWriter != nil {
+		if err := encWriter.Close(); err != nil {
+			return err
+		}
+	}
+	// Apply the limits as the upload form would
+	form := make(url.Values)
+	if opts.limit > 0 {
+		form.Set("limit_downloads", "on")
+		form.Set("download_limit", strconv.Itoa(opts.limit))
+	}
+	if opts.expire > 0 {
+		form.Set("expire", "on")
+		form.Set("expiration_time", strconv.Itoa(opts.expire))
+	}
+	// There is no request to respond to, so keep the error to return
+	var failMsg string
+	fail := func(_ http.ResponseWriter, msg string, _ int) {
+		failMsg = msg
+	}
+	oBuffer, _ := ob.storeBuffer(nil, zipBuffer.Bytes(), encWriter != nil, form, fail)
+	if oBuffer == nil {
+		return errors.New(strings.TrimSuffix(failMsg, "."))
+	}
+	stored = true
+	opts.name = oBuffer.Name
+	return nil
+}
+
+// zipPath adds the file at root to zw, or every file under it if it is a
+// directory. Names are kept relative to root's parent so the shared file
+// or directory keeps its own name. names collects the names added so far,
+// as two paths with the same name would clash in the zip.
+func zipPath(zw *zip.Writer, root string, names map[string]bool, chunk []byte) error {
+	root = filepath.Clean(root)
+	parent := filepath.Dir(root)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Only regular files are shared, links aren't followed
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+		if names[header.Name] {
+			return fmt.Errorf("%s is shared twice, share its parent directory instead", header.Name)
+		}
+		names[header.Name] = true
+		bufFile, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyBuffer(bufFile, f, chunk)
+		return err
+	})
+}
+
+// watchShare closes ob.stop once the shared buffer has been removed from
+// the store, after its last allowed download or when it expires.
+func (ob *onionbox) watchShare() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if oBuffer := ob.store.Get(ob.share.name); oBuffer == nil || oBuffer.IsExpired() {
+			ob.logf("Share %s is no longer available, shutting down", ob.share.name)
+			close(ob.stop)
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"regexp"
+)
+
+// Share IDs name buffers in download links, so anyone who can guess one can
+// download the files. They are 128 random bits written as 26 lowercase
+// base32 characters, which keeps links short and case insensitive.
+const shareIDSize = 16
+
+// shareIDAttempts bounds the retries when a new ID is already taken.
+const shareIDAttempts = 3
+
+var (
+	shareIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+	shareIDPattern  = regexp.MustCompile(`^[a-z2-7]{26}$`)
+)
+
+// createShareID returns a new random share ID.
+func createShareID() (string, error) {
+	b := make([]byte, shareIDSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return shareIDEncoding.EncodeToString(b), nil
+}
+
+// validShareID reports whether id is in the format of a share ID.
+func validShareID(id string) bool {
+	return shareIDPattern.MatchString(id)
+}
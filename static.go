@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"onionbox/templates"
+)
+
+// staticFile is an asset compiled into the binary and served from /static.
+type staticFile struct {
+	contentType string
+	content     string
+}
+
+var (
+	staticFiles = map[string]staticFile{
+		"style.css": {"text/css; charset=utf-8", templates.StyleCSS},
+		"chat.js":   {"text/javascript; charset=utf-8", templates.ChatJS},
+	}
+	// Assets only change with the binary
+	staticModTime = time.Now()
+)
+
+func serveStatic(w http.ResponseWriter, r *http.Request) {
+	file, ok := staticFiles[param(r, "file")]
+	if !ok {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", file.contentType)
+	http.ServeContent(w, r, "", staticModTime, strings.NewReader(file.content))
+}
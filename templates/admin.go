@@ -0,0 +1,26 @@
+package templates
+
+// Too avoid needing HTML files with the static binary
+const AdminHTML = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <title>onionbox - Submissions</title>
+        <meta charset="UTF-8">
+        <link rel="stylesheet" href="/static/style.css">
+    </head>
+    <body>
+        <center>
+        <h2>Submissions</h2>
+        {{range .Submissions}}
+        <form method="post" action="/admin/{{.Name}}?key={{$.Key}}">
+            <input type="hidden" name="token" value="{{$.Token}}" required/>
+            <p><a href="/admin/{{.Name}}?key={{$.Key}}">{{.Name}}.zip</a>, {{.Size}} bytes,
+            received {{.CreatedAt.Format "2006-01-02 15:04 MST"}}, downloaded {{.Downloads}} times
+            <input type="submit" class="button" value="Destroy"></p>
+        </form>
+        {{else}}
+        <p>Nothing has been sent yet.</p>
+        {{end}}
+		</center>
+    </body>
+</html>`
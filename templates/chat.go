@@ -0,0 +1,89 @@
+package templates
+
+// Too avoid needing HTML files with the static binary. The page works
+// without JavaScript, chat.js only saves reloading it.
+const ChatHTML = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <title>onionbox - Chat</title>
+        <meta charset="UTF-8">
+        <link rel="stylesheet" href="/static/style.css">
+        <script src="/static/chat.js" defer></script>
+    </head>
+    <body>
+        <center>
+        <h2>Chat about this share</h2>
+        <p>Messages are only kept in memory and disappear with the files.</p>
+        </center>
+        <ul id="messages" data-after="{{.Last}}" data-poll="{{.PollURL}}">
+            {{range .Messages}}<li>{{.Time}} {{.Name}}{{if .Uploader}} (uploader){{end}}: {{.Text}}</li>
+            {{end}}
+        </ul>
+        <center>
+        <form method="post" id="chat-form">
+            <input type="hidden" name="token" value="{{.Token}}" required/>
+            {{if .Uploader}}<p>You are posting as the uploader.</p>{{end}}
+            Name (optional):<br>
+            <input type="text" name="name" maxlength="32"><br>
+            Message:<br>
+            <input type="text" name="text" maxlength="2000" required><br><br>
+            <input type="submit" class="button" value="Send">
+        </form>
+        <p><a href="">Refresh</a></p>
+        </center>
+    </body>
+</html>`
+
+// ChatJS posts messages and polls for new ones so the chat page doesn't
+// have to be reloaded.
+const ChatJS = `(function () {
+    var list = document.getElementById("messages");
+    var form = document.getElementById("chat-form");
+    if (!list || !form || !window.fetch) {
+        return;
+    }
+    var after = list.getAttribute("data-after");
+    var pollURL = list.getAttribute("data-poll");
+
+    function show(msg) {
+        var item = document.createElement("li");
+        item.textContent = msg.time + " " + msg.name + (msg.uploader ? " (uploader)" : "") + ": " + msg.text;
+        list.appendChild(item);
+    }
+
+    function poll() {
+        fetch(pollURL + "?after=" + after, {credentials: "same-origin"}).then(function (resp) {
+            // The share is gone, and its chat with it
+            if (resp.status === 404 || resp.status === 410) {
+                return;
+            }
+            if (!resp.ok) {
+                throw new Error(resp.statusText);
+            }
+            return resp.json().then(function (data) {
+                data.messages.forEach(show);
+                after = data.last;
+                poll();
+            });
+        }).catch(function () {
+            setTimeout(poll, 5000);
+        });
+    }
+
+    form.addEventListener("submit", function (event) {
+        event.preventDefault();
+        fetch(window.location.href, {
+            method: "POST",
+            body: new URLSearchParams(new FormData(form)),
+            credentials: "same-origin",
+            headers: {"Accept": "application/json"}
+        }).then(function (resp) {
+            if (resp.ok) {
+                form.elements.text.value = "";
+            }
+        });
+    });
+
+    poll();
+})();
+`
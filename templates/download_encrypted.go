@@ -6,6 +6,7 @@ const DownloadHTML = `<!DOCTYPE html>
     <head>
         <title>onionbox - Download Encrypted</title>
         <meta charset="UTF-8">
+        <link rel="stylesheet" href="/static/style.css">
     </head>
     <body>
         <center>
@@ -18,9 +19,4 @@ const DownloadHTML = `<!DOCTYPE html>
         </form>
 		</center>
     </body>
-</html>
-<style type="text/css">
-*{
- font-family: "Courier New", Courier, monospace;
-}
-</style>`
+</html>`
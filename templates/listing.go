@@ -0,0 +1,19 @@
+package templates
+
+// Too avoid needing HTML files with the static binary. Websites bring
+// their own styles, so the listing has none.
+const ListingHTML = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <title>Index of {{.Path}}</title>
+        <meta charset="UTF-8">
+    </head>
+    <body>
+        <h2>Index of {{.Path}}</h2>
+        <ul>
+            {{if ne .Path "/"}}<li><a href="../">../</a></li>{{end}}
+            {{range .Entries}}<li><a href="./{{.}}">{{.}}</a></li>
+            {{end}}
+        </ul>
+    </body>
+</html>`
@@ -0,0 +1,37 @@
+package templates
+
+// Too avoid needing HTML files with the static binary
+const ManageHTML = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <title>onionbox - Manage</title>
+        <meta charset="UTF-8">
+        <link rel="stylesheet" href="/static/style.css">
+    </head>
+    <body>
+        <center>
+        <h2>Manage your upload</h2>
+        <p>Download link: {{.Upload.URL}}</p>
+        <p>Downloads: {{.Upload.Downloads}}{{if .Upload.DownloadLimit}} of {{.Upload.DownloadLimit}}{{end}}</p>
+        <p>Uploaded: {{.Upload.CreatedAt.Format "2006-01-02 15:04 MST"}}</p>
+        <p>Expires: {{if .Upload.ExpiresAt}}{{.Upload.ExpiresAt.Format "2006-01-02 15:04 MST"}}{{else}}never{{end}}</p>
+        {{if .ChatURL}}<p><a href="{{.ChatURL}}">Chat with your recipients</a></p>{{end}}
+        <form method="post">
+            <input type="hidden" name="token" value="{{.Token}}" required/>
+            <input type="hidden" name="action" value="update"/>
+            <h4>Change Limits</h4>
+            Download limit (0 for no limit):<br>
+            <input type="number" name="download_limit" min="0" value="{{.Upload.DownloadLimit}}"><br>
+            Expire in minutes from now (0 for never, empty to keep):<br>
+            <input type="number" name="expiration_time" min="0"><br><br>
+            <input type="submit" class="button" value="Update">
+        </form>
+        <form method="post">
+            <input type="hidden" name="token" value="{{.Token}}" required/>
+            <input type="hidden" name="action" value="destroy"/>
+            <h4>Destroy the files now, the download link will stop working.</h4>
+            <input type="submit" class="button" value="Destroy">
+        </form>
+		</center>
+    </body>
+</html>`
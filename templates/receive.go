@@ -0,0 +1,23 @@
+package templates
+
+// Too avoid needing HTML files with the static binary. Senders can't set
+// any options, the files are kept for the operator only.
+const ReceiveHTML = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <title>onionbox - Send Files</title>
+        <meta charset="UTF-8">
+        <link rel="stylesheet" href="/static/style.css">
+    </head>
+    <body>
+		<center>
+        <h2>Please select the files you would like to send.</h2>
+        <p>Only the operator of this onionbox will be able to see them, no download link is created.</p>
+        <form method="post" enctype="multipart/form-data" action="/">
+            <input type="hidden" name="token" value="{{.}}" required/>
+            <input type="file" name="files" required multiple><br><br>
+            <input type="submit" class="button" value="Send">
+        </form>
+		</center>
+    </body>
+</html>`
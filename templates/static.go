@@ -0,0 +1,7 @@
+package templates
+
+// Served from /static so that pages need no inline styles
+const StyleCSS = `*{
+ font-family: "Courier New", Courier, monospace;
+}
+`
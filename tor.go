@@ -0,0 +1,192 @@
+//go:build !notor
+// +build !notor
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/ipsn/go-libtor"
+	"onionbox/onion_buffer"
+)
+
+// torPublisher runs an embedded Tor and publishes onionbox as an onion
+// service on port 80.
+type torPublisher struct {
+	version3 bool
+	// key is the service's private key, nil to generate a new one
+	key crypto.PrivateKey
+	// clients are the authorized clients' .auth lines by name, if any
+	clients  map[string]string
+	t        *tor.Tor
+	onionSvc *tor.OnionService
+	// serviceDir holds an authorized service's key and socket
+	serviceDir string
+}
+
+func newTorPublisher(version3 bool, key crypto.PrivateKey, clients map[string]string) (publisher, error) {
+	if len(clients) > 0 && !version3 {
+		return nil, errors.New("client authorization needs a version 3 onion service")
+	}
+	return &torPublisher{version3: version3, key: key, clients: clients}, nil
+}
+
+// startTor starts the embedded Tor. It outlives any context passed to
+// the calls that publish or dial through it.
+func startTor() (*tor.Tor, error) {
+	return tor.Start(nil, &tor.StartConf{
+		ProcessCreator: libtor.Creator,
+		DebugWriter:    os.Stderr,
+	})
+}
+
+func (tp *torPublisher) Listen(ctx context.Context) (net.Listener, string, error) {
+	t, err := startTor()
+	if err != nil {
+		return nil, "", err
+	}
+	tp.t = t
+	if len(tp.clients) > 0 {
+		return tp.listenAuthorized(ctx)
+	}
+	// Create an onion service to listen on any port but show as 80
+	onionSvc, err := t.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}, Version3: tp.version3, Key: tp.key})
+	if err != nil {
+		return nil, "", err
+	}
+	tp.onionSvc = onionSvc
+	return onionSvc, "http://" + onionSvc.ID + ".onion", nil
+}
+
+// listenAuthorized publishes a service only the authorized clients can
+// reach. ADD_ONION can't authorize v3 clients in the Tor we embed, so the
+// service is configured as a HiddenServiceDir. The directory is private
+// to the user, kept in memory when the system allows and removed when
+// the publisher is closed. Tor reaches onionbox through a unix socket in
+// it, so local users can't get around client authorization over TCP.
+func (tp *torPublisher) listenAuthorized(ctx context.Context) (net.Listener, string, error) {
+	keyPair, ok := tp.key.(ed25519.KeyPair)
+	if !ok {
+		var err error
+		if keyPair, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, "", err
+		}
+	}
+	root := ""
+	if serviceDirInMemory() {
+		root = serviceDirRoot
+	}
+	hsDir, err := ioutil.TempDir(root, "onionbox-service-")
+	if err != nil {
+		return nil, "", err
+	}
+	tp.serviceDir = hsDir
+	clientsDir := filepath.Join(hsDir, "authorized_clients")
+	if err := os.Mkdir(clientsDir, 0700); err != nil {
+		return nil, "", err
+	}
+	secret := append(append([]byte{}, torKeyHeader...), keyPair.PrivateKey()...)
+	err = ioutil.WriteFile(filepath.Join(hsDir, serviceKeyFile), secret, 0600)
+	onion_buffer.Wipe(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	for name, line := range tp.clients {
+		if err := ioutil.WriteFile(filepath.Join(clientsDir, name+authFileSuffix), []byte(line+"\n"), 0600); err != nil {
+			return nil, "", err
+		}
+	}
+	socket := filepath.Join(hsDir, "onionbox.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, "", err
+	}
+	err = tp.t.Control.SetConf(
+		control.NewKeyVal("HiddenServiceDir", hsDir),
+		control.NewKeyVal("HiddenServiceVersion", "3"),
+		control.NewKeyVal("HiddenServicePort", "80 unix:"+socket),
+	)
+	if err == nil {
+		err = tp.t.EnableNetwork(ctx, true)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, "", err
+	}
+	return ln, "http://" + torutil.OnionServiceIDFromPrivateKey(keyPair) + ".onion", nil
+}
+
+// serviceKeyFile is the name Tor reads a HiddenServiceDir's key from.
+const serviceKeyFile = "hs_ed25519_secret_key"
+
+// removeServiceDir zeroes the key in an authorized service's directory
+// before removing it.
+func removeServiceDir(dir string) error {
+	keyPath := filepath.Join(dir, serviceKeyFile)
+	if f, err := os.OpenFile(keyPath, os.O_WRONLY, 0); err == nil {
+		if info, err := f.Stat(); err == nil {
+			zeros := make([]byte, info.Size())
+			f.Write(zeros)
+			f.Sync()
+		}
+		f.Close()
+	}
+	return os.RemoveAll(dir)
+}
+
+// Close removes the onion service, if the server hasn't already by closing
+// its listener, then stops Tor and removes the authorized service's
+// directory.
+func (tp *torPublisher) Close() error {
+	var firstErr error
+	if tp.onionSvc != nil {
+		firstErr = tp.onionSvc.Close()
+	}
+	if tp.t != nil {
+		if err := tp.t.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if tp.serviceDir != "" {
+		if err := removeServiceDir(tp.serviceDir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// torDialer connects the client to onion services through an embedded
+// Tor's SOCKS proxy.
+type torDialer struct {
+	*tor.Dialer
+	t *tor.Tor
+}
+
+func newTorDialer(ctx context.Context) (dialer, error) {
+	t, err := startTor()
+	if err != nil {
+		return nil, err
+	}
+	// Waits for Tor to bootstrap
+	d, err := t.Dialer(ctx, nil)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return &torDialer{Dialer: d, t: t}, nil
+}
+
+func (td *torDialer) Close() error {
+	return td.t.Close()
+}
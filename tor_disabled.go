@@ -0,0 +1,21 @@
+//go:build notor
+// +build notor
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+)
+
+// Builds tagged notor leave out the embedded Tor, which takes a long time
+// to compile, and can only serve with -local.
+func newTorPublisher(version3 bool, key crypto.PrivateKey, clients map[string]string) (publisher, error) {
+	return nil, errors.New("built without Tor, run with -local")
+}
+
+// The client can still reach servers run with -local.
+func newTorDialer(ctx context.Context) (dialer, error) {
+	return nil, errors.New("built without Tor, only servers run with -local can be reached")
+}
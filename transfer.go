@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"onionbox/onion_buffer"
+)
+
+// serveBuffer writes a buffer's content to the client. Range and
+// conditional requests are supported so interrupted downloads over slow
+// circuits can be resumed instead of starting over. Each request holds one
+// of the buffer's remaining downloads while it runs, and downloads are
+// counted by the bytes delivered, so partial requests can't add up to more
+// of the content than the limit allows. A request for the whole content
+// is refused unless what's left of the allowance covers all of it, rather
+// than cutting it short.
+func (ob *onionbox) serveBuffer(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer, content io.ReadSeeker, fail errorFunc) {
+	if !oBuffer.StartDownload() {
+		if oBuffer.LimitReached() {
+			ob.limitReached(w, oBuffer, fail)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(downloadRetryAfter))
+		fail(w, "All remaining downloads are in progress, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		oBuffer.EndDownload(0)
+		ob.logf("Error finding size of %s: %v", oBuffer.Name, err)
+		fail(w, "Error reading buffer.", http.StatusInternalServerError)
+		return
+	}
+	// The checksum identifies the stored bytes, so it makes a strong ETag
+	// for If-Range checks on resume
+	etag := fmt.Sprintf("%q", oBuffer.Checksum)
+	tracker := &transferTracker{ReadSeeker: content, buffer: oBuffer, size: size}
+	if wholeContent(r, etag) {
+		if !oBuffer.ChargeBytes(size, size) {
+			oBuffer.EndDownload(size)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			fail(w, "Only part of a download is left, resume it with a Range request.", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		tracker.charged = size
+	}
+	// Set headers for browser to initiate download
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", oBuffer.Name))
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", oBuffer.CreatedAt, tracker)
+	// Give back what was charged but never sent, as for HEAD requests,
+	// unmodified content or dropped connections
+	oBuffer.RefundBytes(tracker.charged)
+	// Stop new downloads as soon as the limit is hit, transfers still in
+	// flight hold a reader so the buffer isn't wiped underneath them
+	if oBuffer.EndDownload(tracker.size) {
+		ob.logf("Download limit reached for %s", oBuffer.Name)
+		if err := ob.store.Delete(oBuffer); err != nil {
+			ob.logf("Error deleting onion file from store: %v", err)
+		}
+	}
+}
+
+// downloadRetryAfter is how many seconds a client is asked to wait when
+// every remaining download of a buffer is in progress.
+const downloadRetryAfter = 5
+
+// errDownloadLimit stops a transfer once the bytes its buffer's download
+// limit allows have been delivered.
+var errDownloadLimit = errors.New("download limit reached")
+
+// wholeContent reports whether http.ServeContent will answer r with the
+// whole content rather than a range of it.
+func wholeContent(r *http.Request, etag string) bool {
+	if r.Header.Get("Range") == "" {
+		return true
+	}
+	ifRange := r.Header.Get("If-Range")
+	return ifRange != "" && ifRange != etag
+}
+
+// transferTracker takes every byte read for the client from its buffer's
+// download allowance, first from the charged bytes paid for up front.
+type transferTracker struct {
+	io.ReadSeeker
+	buffer  *onion_buffer.OnionBuffer
+	size    int64
+	charged int64
+}
+
+func (t *transferTracker) Read(p []byte) (int, error) {
+	n, err := t.ReadSeeker.Read(p)
+	paid := int64(n)
+	if paid > t.charged {
+		paid = t.charged
+	}
+	t.charged -= paid
+	if extra := int64(n) - paid; extra > 0 {
+		if granted := t.buffer.DeliverBytes(extra, t.size); granted < extra {
+			return int(paid + granted), errDownloadLimit
+		}
+	}
+	return n, err
+}
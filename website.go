@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"onionbox/onion_buffer"
+	"onionbox/templates"
+)
+
+// websiteCSP is the default Content-Security-Policy for websites. Pages
+// can only load their own scripts, styles and media, never inline ones,
+// and can't be framed or submit forms anywhere.
+const websiteCSP = "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'; form-action 'none'; " +
+	"base-uri 'none'"
+
+// websiteTypes adds Content-Types that the mime package may not know
+// without a system mime.types file. Anything else is found by
+// http.ServeContent from the file extension, or sniffed.
+var websiteTypes = map[string]string{
+	".txt":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".mp3":   "audio/mpeg",
+	".ogg":   "audio/ogg",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+}
+
+// websiteOptions configures onionbox website, which publishes a directory
+// as an onion website instead of taking uploads. Every file is loaded into
+// a buffer in the store, named by its slash separated path within the
+// directory, so it is kept out of swap and wiped on shutdown like any
+// upload.
+type websiteOptions struct {
+	root     string
+	listings bool
+	csp      string
+	// dirs holds the sorted entries of every directory in the site by
+	// path, "" for the root, with subdirectories ending in a slash
+	dirs map[string][]string
+}
+
+func (opts *websiteOptions) flags(fs *flag.FlagSet) {
+	fs.BoolVar(&opts.listings, "listings", false, "list the files in directories without an index.html")
+	fs.StringVar(&opts.csp, "csp", websiteCSP, "Content-Security-Policy sent with every page")
+}
+
+// loadWebsite reads every file under the website's root into the store.
+func (ob *onionbox) loadWebsite() error {
+	opts := ob.website
+	info, err := os.Stat(opts.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", opts.root)
+	}
+	opts.dirs = make(map[string][]string)
+	return filepath.Walk(opts.root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(opts.root, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			if name == "." {
+				opts.dirs[""] = []string{}
+				return nil
+			}
+			opts.dirs[name] = []string{}
+			opts.addEntry(name, info.Name()+"/")
+			return nil
+		}
+		// Only regular files are published, links aren't followed
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		// The store locks the buffer's memory as it is added
+		oBuffer := &onion_buffer.OnionBuffer{Name: name, Bytes: data, CreatedAt: info.ModTime()}
+		if err := ob.store.Add(oBuffer); err != nil {
+			onion_buffer.Wipe(data)
+			return fmt.Errorf("adding %s: %v", name, err)
+		}
+		opts.addEntry(name, info.Name())
+		return nil
+	})
+}
+
+// addEntry lists entry in the directory holding the file or directory
+// name. Walk visits files in lexical order, so entries stay sorted.
+func (opts *websiteOptions) addEntry(name, entry string) {
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	opts.dirs[dir] = append(opts.dirs[dir], entry)
+}
+
+func (ob *onionbox) serveWebsite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", ob.website.csp)
+	name := strings.TrimPrefix(path.Clean("/"+param(r, "path")), "/")
+	if entries, ok := ob.website.dirs[name]; ok {
+		// Relative links in a directory's pages need the trailing slash
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, "/"+name+"/", http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(name, "index.html")
+		if ob.store.Get(index) != nil {
+			ob.serveWebsiteFile(w, r, index)
+			return
+		}
+		if !ob.website.listings {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		ob.serveListing(w, r, name, entries)
+		return
+	}
+	ob.serveWebsiteFile(w, r, name)
+}
+
+func (ob *onionbox) serveWebsiteFile(w http.ResponseWriter, r *http.Request, name string) {
+	oBuffer := ob.store.Get(name)
+	if oBuffer == nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	reader, err := oBuffer.NewReader()
+	if err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+	if contentType, ok := websiteTypes[strings.ToLower(path.Ext(name))]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, name, oBuffer.CreatedAt, reader)
+}
+
+func (ob *onionbox) serveListing(w http.ResponseWriter, r *http.Request, name string, entries []string) {
+	// Parse template
+	t, err := template.New("listing").Parse(templates.ListingHTML)
+	if err != nil {
+		ob.logf("Error loading template: %v", err)
+		http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+	// Execute template
+	data := struct {
+		Path    string
+		Entries []string
+	}{"/" + name, entries}
+	if name != "" {
+		data.Path += "/"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := t.Execute(w, data); err != nil {
+		ob.logf("Error executing template: %v", err)
+		http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+}